@@ -1,90 +1,350 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "encoding/json"
+    "errors"
+    "expvar"
     "fmt"
     "log"
+    "net"
     "net/http"
+    "net/url"
     "strconv"
-    _ "github.com/go-sql-driver/mysql"
+    "strings"
     "github.com/gorilla/mux"
     "os"
+    "os/signal"
+    "syscall"
     "time"
 )
 
 type App struct {
     Router *mux.Router
     DB *sql.DB
+    Movies MovieStore
+    Categories CategoryStore
+    // QueryTimeout bounds the store calls of a request; RouteTimeouts
+    // overrides it per route name.
+    QueryTimeout time.Duration
+    RouteTimeouts map[string]time.Duration
+    // ShutdownGracePeriod bounds how long Run drains in-flight requests.
+    ShutdownGracePeriod time.Duration
+    // CatalogCacheTTL is how long a rendered /catalog response is reused.
+    CatalogCacheTTL time.Duration
+    // MaxBodyBytes caps the size of request bodies.
+    MaxBodyBytes int64
+    // DebugAddr is where Run serves /debug/vars, apart from the public
+    // router; empty disables it.
+    DebugAddr string
+
+    // store is the SQL backend Connect waits for; nil for the memory backend.
+    store *sqlStore
+    index *movieIndex
+    catalog *catalogCache
 }
 
 func (a *App) Initialize(user, password, dbname string) {
+    if err := a.loadConfig(); err != nil {
+        log.Fatal(err)
+    }
+
+    // STORAGE_BACKEND=memory runs the API without a database server.
+    if os.Getenv("STORAGE_BACKEND") == "memory" {
+        store := newMemoryStore()
+        a.InitializeWithStores(store, store)
+        return
+    }
+
+    store, err := a.openStore(user, password, dbname)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    a.store = store
+    a.InitializeWithStores(store, store)
+}
+
+// openStore connects to the SQL backend named by DATABASE_URL, falling back
+// to a local MySQL database.
+func (a *App) openStore(user, password, dbname string) (*sqlStore, error) {
     connectionString := os.Getenv("DATABASE_URL")
 
     if (connectionString == "") {
         connectionString = fmt.Sprintf("%s:%s@/%s", user, password, dbname)
     }
 
-    var err error
-    a.DB, err = sql.Open("mysql", connectionString)
+    d, dsn, err := dialectFor(connectionString)
     if err != nil {
-        log.Fatal(err)
+        return nil, err
     }
 
-    a.DB.SetMaxIdleConns(0)
-    a.DB.SetConnMaxLifetime(time.Second * 10)
-
-    const categoriesTableCreationQuery = `
-    CREATE TABLE IF NOT EXISTS categories
-    (
-        id INT AUTO_INCREMENT PRIMARY KEY,
-        title VARCHAR(50) NOT NULL
-    )`
-
-    const moviesTableCreationQuery = `
-    CREATE TABLE IF NOT EXISTS movies
-    (
-        id INT AUTO_INCREMENT PRIMARY KEY,
-        title VARCHAR(120) NOT NULL,
-        cover VARCHAR(255),
-        category_id INT NOT NULL,
-        description text,
-        FOREIGN KEY (category_id) REFERENCES Categories(id)
-    )`
-
-    if _, err := a.DB.Exec(categoriesTableCreationQuery); err != nil {
-        log.Fatal(err)
+    pool, err := poolConfigFromEnv()
+    if err != nil {
+        return nil, err
     }
 
-    if _, err := a.DB.Exec(moviesTableCreationQuery); err != nil {
-        log.Fatal(err)
+    if d.driver == sqliteDialect.driver {
+        // SQLite allows a single writer, so keep exactly one connection open.
+        pool.maxOpenConns = 1
+        pool.maxIdleConns = 1
     }
 
+    a.DB, err = sql.Open(d.driver, dsn)
+    if err != nil {
+        return nil, err
+    }
+    pool.apply(a.DB)
+
+    return newSQLStore(a.DB, d), nil
+}
+
+// InitializeWithStores wires the router against the given persistence backends.
+func (a *App) InitializeWithStores(movies MovieStore, categories CategoryStore) {
+    a.Movies = movies
+    a.Categories = categories
+    a.index = newMovieIndex()
+    a.catalog = newCatalogCache(a.CatalogCacheTTL)
     a.Router = mux.NewRouter()
     a.initializeRoutes()
 }
 
-//
+// Run serves the API on addr until SIGTERM or SIGINT, then shuts down.
 func (a *App) Run(addr string) {
     log.Println(addr)
-    log.Fatal(http.ListenAndServe(addr, a.Router))
+
+    listener, err := net.Listen("tcp", addr)
+    if err != nil {
+        log.Fatal(err)
+    }
+
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+
+    if err := a.serve(listener, stop); err != nil {
+        log.Fatal(err)
+    }
+}
+
+// serve serves the API on listener, and /debug/vars on DebugAddr, until
+// stop receives. It then stops accepting connections, drains in-flight
+// requests for up to ShutdownGracePeriod, shuts the debug listener down and
+// closes the database.
+func (a *App) serve(listener net.Listener, stop <-chan os.Signal) error {
+    server := &http.Server{
+        Handler: a.Router,
+        ReadHeaderTimeout: 5 * time.Second,
+        ReadTimeout: 10 * time.Second,
+        WriteTimeout: a.writeTimeout(),
+        IdleTimeout: 120 * time.Second,
+    }
+
+    errs := make(chan error, 1)
+    go func() {
+        errs <- server.Serve(listener)
+    }()
+
+    debug := a.debugServer()
+    if debug != nil {
+        go func() {
+            log.Printf("debug %s", debug.Addr)
+            if err := debug.ListenAndServe(); err != http.ErrServerClosed {
+                log.Printf("debug listener: %v", err)
+            }
+        }()
+    }
+
+    select {
+    case err := <-errs:
+        return err
+    case sig := <-stop:
+        log.Printf("received %s, shutting down", sig)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), a.ShutdownGracePeriod)
+    defer cancel()
+
+    if err := server.Shutdown(ctx); err != nil {
+        log.Printf("shutdown: %v", err)
+    }
+    if debug != nil {
+        if err := debug.Shutdown(ctx); err != nil {
+            log.Printf("debug shutdown: %v", err)
+        }
+    }
+
+    if err := a.Close(); err != nil {
+        log.Printf("closing database: %v", err)
+    }
+    return nil
+}
+
+// writeTimeout gives the slowest route its whole query timeout plus time to
+// write the response, so the server never cuts off a response the route is
+// still allowed to produce. It is at least 30s.
+func (a *App) writeTimeout() time.Duration {
+    longest := a.QueryTimeout
+    for _, timeout := range a.RouteTimeouts {
+        if timeout > longest {
+            longest = timeout
+        }
+    }
+
+    if timeout := longest + 10*time.Second; timeout > 30*time.Second {
+        return timeout
+    }
+    return 30 * time.Second
+}
+
+// debugServer serves the expvar counters on DebugAddr, an internal address
+// kept off the public router, or is nil when DebugAddr is empty.
+func (a *App) debugServer() *http.Server {
+    if a.DebugAddr == "" {
+        return nil
+    }
+
+    mux := http.NewServeMux()
+    mux.Handle("/debug/vars", expvar.Handler())
+
+    return &http.Server{
+        Addr: a.DebugAddr,
+        Handler: mux,
+        ReadHeaderTimeout: 5 * time.Second,
+    }
+}
+
+// Close releases the cached statements and the database connections.
+func (a *App) Close() error {
+    if a.store != nil {
+        a.store.Close()
+    }
+
+    if a.DB != nil {
+        return a.DB.Close()
+    }
+
+    return nil
 }
 
 // Routes
 func (a *App) initializeRoutes() {
-    a.Router.HandleFunc("/movies", a.getMovies).Methods("GET")
-    a.Router.HandleFunc("/movies", a.createMovie).Methods("POST")
-    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.getMovie).Methods("GET")
-    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.updateMovie).Methods("PUT")
-    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.deleteMovie).Methods("DELETE")
+    a.Router.HandleFunc("/movies", a.getMovies).Methods("GET").Name("getMovies")
+    a.Router.HandleFunc("/movies", a.createMovie).Methods("POST").Name("createMovie")
+    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.getMovie).Methods("GET").Name("getMovie")
+    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.updateMovie).Methods("PUT").Name("updateMovie")
+    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.patchMovie).Methods("PATCH").Name("patchMovie")
+    a.Router.HandleFunc("/movies/{id:[0-9]+}", a.deleteMovie).Methods("DELETE").Name("deleteMovie")
+
+    a.Router.HandleFunc("/categories", a.getCategories).Methods("GET").Name("getCategories")
+    a.Router.HandleFunc("/categories", a.createCategory).Methods("POST").Name("createCategory")
+    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.getCategory).Methods("GET").Name("getCategory")
+    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.updateCategory).Methods("PUT").Name("updateCategory")
+    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.patchCategory).Methods("PATCH").Name("patchCategory")
+    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.deleteCategory).Methods("DELETE").Name("deleteCategory")
+
+    a.Router.HandleFunc("/catalog", a.getMovieCatalog).Methods("GET").Name("getMovieCatalog")
+    a.Router.HandleFunc("/catalog/{id:[0-9]+}", a.getCatalogShelf).Methods("GET").Name("getCatalogShelf")
 
-    a.Router.HandleFunc("/categories", a.getCategories).Methods("GET")
-    a.Router.HandleFunc("/categories", a.createCategory).Methods("POST")
-    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.getCategory).Methods("GET")
-    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.updateCategory).Methods("PUT")
-    a.Router.HandleFunc("/categories/{id:[0-9]+}", a.deleteCategory).Methods("DELETE")
+    a.Router.HandleFunc("/search", a.search).Methods("GET").Name("search")
+    a.Router.HandleFunc("/autocomplete", a.autocomplete).Methods("GET").Name("autocomplete")
 
-    a.Router.HandleFunc("/catalog", a.getMovieCatalog).Methods("GET")
+    a.Router.HandleFunc("/healthz", a.getHealth).Methods("GET").Name("getHealth")
+    a.Router.HandleFunc("/readyz", a.getReadiness).Methods("GET").Name("getReadiness")
+
+    a.Router.Use(requestIDMiddleware)
+    a.Router.Use(a.timeoutMiddleware)
+
+    // mux runs the middleware only for matched routes, so these wrap it.
+    a.Router.NotFoundHandler = requestIDMiddleware(http.HandlerFunc(notFound))
+    a.Router.MethodNotAllowedHandler = requestIDMiddleware(http.HandlerFunc(methodNotAllowed))
+}
+
+// loadConfig reads QUERY_TIMEOUT (default 5s), ROUTE_TIMEOUTS, a comma
+// separated list of route=duration pairs such as "getMovieCatalog=10s",
+// SHUTDOWN_GRACE_PERIOD (default 30s), CATALOG_CACHE_TTL (default 5m, 0
+// disables the cache), MAX_BODY_BYTES (default 1MiB) and DEBUG_ADDR (default
+// localhost:6060, empty disables the debug listener).
+func (a *App) loadConfig() error {
+    a.DebugAddr = "localhost:6060"
+    if value, ok := os.LookupEnv("DEBUG_ADDR"); ok {
+        a.DebugAddr = value
+    }
+
+    a.MaxBodyBytes = defaultMaxBodyBytes
+    if value := os.Getenv("MAX_BODY_BYTES"); value != "" {
+        limit, err := strconv.ParseInt(value, 10, 64)
+        if err != nil || limit < 1 {
+            return fmt.Errorf("MAX_BODY_BYTES: expected a positive byte count, got %q", value)
+        }
+        a.MaxBodyBytes = limit
+    }
+
+    a.CatalogCacheTTL = 5 * time.Minute
+    if value := os.Getenv("CATALOG_CACHE_TTL"); value != "" {
+        ttl, err := time.ParseDuration(value)
+        if err != nil {
+            return fmt.Errorf("CATALOG_CACHE_TTL: %v", err)
+        }
+        a.CatalogCacheTTL = ttl
+    }
+
+    a.ShutdownGracePeriod = 30 * time.Second
+    if value := os.Getenv("SHUTDOWN_GRACE_PERIOD"); value != "" {
+        period, err := time.ParseDuration(value)
+        if err != nil {
+            return fmt.Errorf("SHUTDOWN_GRACE_PERIOD: %v", err)
+        }
+        a.ShutdownGracePeriod = period
+    }
+
+    a.QueryTimeout = 5 * time.Second
+    if value := os.Getenv("QUERY_TIMEOUT"); value != "" {
+        timeout, err := time.ParseDuration(value)
+        if err != nil {
+            return fmt.Errorf("QUERY_TIMEOUT: %v", err)
+        }
+        a.QueryTimeout = timeout
+    }
+
+    a.RouteTimeouts = map[string]time.Duration{}
+    for _, pair := range strings.Split(os.Getenv("ROUTE_TIMEOUTS"), ",") {
+        if strings.TrimSpace(pair) == "" {
+            continue
+        }
+        parts := strings.SplitN(pair, "=", 2)
+        if len(parts) != 2 {
+            return fmt.Errorf("ROUTE_TIMEOUTS: expected route=duration, got %q", pair)
+        }
+        timeout, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+        if err != nil {
+            return fmt.Errorf("ROUTE_TIMEOUTS: %v", err)
+        }
+        a.RouteTimeouts[strings.TrimSpace(parts[0])] = timeout
+    }
+
+    return nil
+}
+
+// timeoutMiddleware gives each request a context that is cancelled when the
+// client goes away or the route's deadline passes.
+func (a *App) timeoutMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        timeout := a.QueryTimeout
+        if route := mux.CurrentRoute(r); route != nil {
+            if routeTimeout, ok := a.RouteTimeouts[route.GetName()]; ok {
+                timeout = routeTimeout
+            }
+        }
+
+        if timeout > 0 {
+            ctx, cancel := context.WithTimeout(r.Context(), timeout)
+            defer cancel()
+            r = r.WithContext(ctx)
+        }
+
+        next.ServeHTTP(w, r)
+    })
 }
 
 // Movies
@@ -92,20 +352,15 @@ func (a *App) getMovie(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid movie ID")
+        respondWithError(w, r, http.StatusBadRequest, "Invalid movie ID")
         return
     }
     m := Movie{ID: id}
-    if err := m.getMovie(a.DB); err != nil {
-        switch err {
-        case sql.ErrNoRows:
-            respondWithError(w, http.StatusNotFound, "Movie not found")
-        default:
-            respondWithError(w, http.StatusInternalServerError, err.Error())
-        }
+    if err := a.Movies.GetMovie(r.Context(), &m); err != nil {
+        respondWithStoreError(w, r, err)
         return
     }
-    respondWithJSON(w, http.StatusOK, m)
+    respondWithTaggedJSON(w, r, m)
 }
 func (a *App) getMovies(w http.ResponseWriter, r *http.Request) {
     count, _ := strconv.Atoi(r.FormValue("count"))
@@ -116,60 +371,189 @@ func (a *App) getMovies(w http.ResponseWriter, r *http.Request) {
     if start < 0 {
         start = 0
     }
-    movies, err := getMovies(a.DB, start, count)
+    query := MovieQuery{Start: start, Count: count, Search: r.FormValue("q"), Sort: "id"}
+    if category := r.FormValue("category"); category != "" {
+        id, err := strconv.Atoi(category)
+        if err != nil {
+            respondWithError(w, r, http.StatusBadRequest, "Invalid category ID")
+            return
+        }
+        query.Category = id
+    }
+    if sort := r.FormValue("sort"); sort != "" {
+        if _, ok := movieSortColumns[sort]; !ok {
+            respondWithError(w, r, http.StatusBadRequest, "Invalid sort field")
+            return
+        }
+        query.Sort = sort
+    }
+    switch r.FormValue("order") {
+    case "", "asc":
+    case "desc":
+        query.Descending = true
+    default:
+        respondWithError(w, r, http.StatusBadRequest, "Invalid sort order")
+        return
+    }
+    values := r.URL.Query()
+    if _, ok := values["after"]; ok {
+        a.getMoviePage(w, r, query)
+        return
+    }
+    if _, ok := values["before"]; ok {
+        a.getMoviePage(w, r, query)
+        return
+    }
+    movies, err := a.Movies.GetMovies(r.Context(), query)
     if err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+        respondWithStoreError(w, r, err)
         return
     }
-    respondWithJSON(w, http.StatusOK, movies)
+    respondWithTaggedJSON(w, r, movies)
 }
 func (a *App) createMovie(w http.ResponseWriter, r *http.Request) {
     var m Movie
-    decoder := json.NewDecoder(r.Body)
-    if err := decoder.Decode(&m); err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+    if !a.decodeJSON(w, r, &m) {
+        return
+    }
+    violations, err := a.validateMovie(r.Context(), m)
+    if err != nil {
+        respondWithStoreError(w, r, err)
         return
     }
-    defer r.Body.Close()
-    if err := m.createMovie(a.DB); err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+    if len(violations) > 0 {
+        respondWithViolations(w, r, violations)
         return
     }
+    if err := a.Movies.CreateMovie(r.Context(), &m); err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+    a.index.add(m)
+    a.catalog.invalidate()
     respondWithJSON(w, http.StatusCreated, m)
 }
 func (a *App) updateMovie(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid movie ID")
+        respondWithError(w, r, http.StatusBadRequest, "Invalid movie ID")
+        return
+    }
+    matched, ok := checkIfMatch(w, r, a.currentMovie(r, id))
+    if !ok {
+        return
+    }
+    var m Movie
+    if !a.decodeJSON(w, r, &m) {
+        return
+    }
+    m.ID = id
+    // Pin the write to the version If-Match saw, so the store rejects it if
+    // another write lands in between.
+    if current, ok := matched.(Movie); ok {
+        m.Version = current.Version
+    }
+    violations, err := a.validateMovie(r.Context(), m)
+    if err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+    if len(violations) > 0 {
+        respondWithViolations(w, r, violations)
+        return
+    }
+    if err := a.Movies.UpdateMovie(r.Context(), &m); err != nil {
+        if err == errVersionConflict {
+            respondWithConflict(w, r, a.currentMovie(r, id))
+            return
+        }
+        respondWithStoreError(w, r, err)
+        return
+    }
+    a.index.update(m)
+    a.catalog.invalidate()
+    respondWithUpdated(w, m)
+}
+// patchMovie applies a JSON Merge Patch, so only the fields present change.
+// Unless the patch names a version, it applies to the version it was merged
+// onto, and a concurrent write makes it fail with 409.
+func (a *App) patchMovie(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    id, err := strconv.Atoi(vars["id"])
+    if err != nil {
+        respondWithError(w, r, http.StatusBadRequest, "Invalid movie ID")
+        return
+    }
+    matched, ok := checkIfMatch(w, r, a.currentMovie(r, id))
+    if !ok {
+        return
+    }
+    var patch map[string]interface{}
+    if !a.decodeJSON(w, r, &patch) {
+        return
+    }
+    if patch == nil {
+        respondWithError(w, r, http.StatusBadRequest, "Request body must be a JSON object")
         return
     }
+    // Patch the representation If-Match matched, not a fresh read.
+    current, pinned := matched.(Movie)
+    if !pinned {
+        current = Movie{ID: id}
+        if err := a.Movies.GetMovie(r.Context(), &current); err != nil {
+            respondWithStoreError(w, r, err)
+            return
+        }
+    }
     var m Movie
-    decoder := json.NewDecoder(r.Body)
-    if err := decoder.Decode(&m); err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+    if err := applyMergePatch(current, patch, &m); err != nil {
+        respondWithError(w, r, http.StatusBadRequest, decodeErrorMessage(err))
         return
     }
-    defer r.Body.Close()
     m.ID = id
-    if err := m.updateMovie(a.DB); err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+    if pinned {
+        m.Version = current.Version
+    }
+    violations, err := a.validateMovie(r.Context(), m)
+    if err != nil {
+        respondWithStoreError(w, r, err)
         return
     }
-    respondWithJSON(w, http.StatusOK, m)
+    if len(violations) > 0 {
+        respondWithViolations(w, r, violations)
+        return
+    }
+    if err := a.Movies.UpdateMovie(r.Context(), &m); err != nil {
+        if err == errVersionConflict {
+            respondWithConflict(w, r, a.currentMovie(r, id))
+            return
+        }
+        respondWithStoreError(w, r, err)
+        return
+    }
+    if err := a.Movies.GetMovie(r.Context(), &m); err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+    a.index.update(m)
+    a.catalog.invalidate()
+    respondWithUpdated(w, m)
 }
 func (a *App) deleteMovie(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid movie ID")
+        respondWithError(w, r, http.StatusBadRequest, "Invalid movie ID")
         return
     }
     m := Movie{ID: id}
-    if err := m.deleteMovie(a.DB); err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+    if err := a.Movies.DeleteMovie(r.Context(), &m); err != nil {
+        respondWithStoreError(w, r, err)
         return
     }
+    a.index.remove(m.ID)
+    a.catalog.invalidate()
     respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
@@ -178,96 +562,394 @@ func (a *App) getCategory(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+        respondWithError(w, r, http.StatusBadRequest, "Invalid category ID")
         return
     }
     m := Category{ID: id}
-    if err := m.getCategory(a.DB); err != nil {
-        switch err {
-        case sql.ErrNoRows:
-            respondWithError(w, http.StatusNotFound, "Category not found")
-        default:
-            respondWithError(w, http.StatusInternalServerError, err.Error())
-        }
+    if err := a.Categories.GetCategory(r.Context(), &m); err != nil {
+        respondWithStoreError(w, r, err)
         return
     }
-    respondWithJSON(w, http.StatusOK, m)
+    respondWithTaggedJSON(w, r, m)
 }
 func (a *App) getCategories(w http.ResponseWriter, r *http.Request) {
-    movies, err := getCategories(a.DB)
+    movies, err := a.Categories.GetCategories(r.Context())
     if err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+        respondWithStoreError(w, r, err)
         return
     }
     respondWithJSON(w, http.StatusOK, movies)
 }
 func (a *App) createCategory(w http.ResponseWriter, r *http.Request) {
     var m Category
-    decoder := json.NewDecoder(r.Body)
-    if err := decoder.Decode(&m); err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid request payload")
+    if !a.decodeJSON(w, r, &m) {
         return
     }
-    defer r.Body.Close()
-    if err := m.createCategory(a.DB); err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+    if violations := validateCategory(m); len(violations) > 0 {
+        respondWithViolations(w, r, violations)
         return
     }
+    if err := a.Categories.CreateCategory(r.Context(), &m); err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+    a.catalog.invalidate()
     respondWithJSON(w, http.StatusCreated, m)
 }
 func (a *App) updateCategory(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+        respondWithError(w, r, http.StatusBadRequest, "Invalid category ID")
+        return
+    }
+    matched, ok := checkIfMatch(w, r, a.currentCategory(r, id))
+    if !ok {
         return
     }
     var m Category
-    decoder := json.NewDecoder(r.Body)
-    if err := decoder.Decode(&m); err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid resquest payload")
+    if !a.decodeJSON(w, r, &m) {
         return
     }
-    defer r.Body.Close()
     m.ID = id
-    if err := m.updateCategory(a.DB); err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+    if current, ok := matched.(Category); ok {
+        m.Version = current.Version
+    }
+    if violations := validateCategory(m); len(violations) > 0 {
+        respondWithViolations(w, r, violations)
+        return
+    }
+    if err := a.Categories.UpdateCategory(r.Context(), &m); err != nil {
+        if err == errVersionConflict {
+            respondWithConflict(w, r, a.currentCategory(r, id))
+            return
+        }
+        respondWithStoreError(w, r, err)
         return
     }
-    respondWithJSON(w, http.StatusOK, m)
+    a.catalog.invalidate()
+    respondWithUpdated(w, m)
+}
+// patchCategory is patchMovie for categories.
+func (a *App) patchCategory(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    id, err := strconv.Atoi(vars["id"])
+    if err != nil {
+        respondWithError(w, r, http.StatusBadRequest, "Invalid category ID")
+        return
+    }
+    matched, ok := checkIfMatch(w, r, a.currentCategory(r, id))
+    if !ok {
+        return
+    }
+    var patch map[string]interface{}
+    if !a.decodeJSON(w, r, &patch) {
+        return
+    }
+    if patch == nil {
+        respondWithError(w, r, http.StatusBadRequest, "Request body must be a JSON object")
+        return
+    }
+    current, pinned := matched.(Category)
+    if !pinned {
+        current = Category{ID: id}
+        if err := a.Categories.GetCategory(r.Context(), &current); err != nil {
+            respondWithStoreError(w, r, err)
+            return
+        }
+    }
+    var c Category
+    if err := applyMergePatch(current, patch, &c); err != nil {
+        respondWithError(w, r, http.StatusBadRequest, decodeErrorMessage(err))
+        return
+    }
+    c.ID = id
+    if pinned {
+        c.Version = current.Version
+    }
+    if violations := validateCategory(c); len(violations) > 0 {
+        respondWithViolations(w, r, violations)
+        return
+    }
+    if err := a.Categories.UpdateCategory(r.Context(), &c); err != nil {
+        if err == errVersionConflict {
+            respondWithConflict(w, r, a.currentCategory(r, id))
+            return
+        }
+        respondWithStoreError(w, r, err)
+        return
+    }
+    if err := a.Categories.GetCategory(r.Context(), &c); err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+    a.catalog.invalidate()
+    respondWithUpdated(w, c)
 }
 func (a *App) deleteCategory(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     id, err := strconv.Atoi(vars["id"])
     if err != nil {
-        respondWithError(w, http.StatusBadRequest, "Invalid category ID")
+        respondWithError(w, r, http.StatusBadRequest, "Invalid category ID")
         return
     }
     c := Category{ID: id}
-    if err := c.deleteCategory(a.DB); err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+    if err := a.Categories.DeleteCategory(r.Context(), &c); err != nil {
+        respondWithStoreError(w, r, err)
         return
     }
+    a.catalog.invalidate()
     respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
 
+// currentMovie returns a loader for the stored movie, rendered as GET would,
+// for If-Match checks and conflict responses.
+func (a *App) currentMovie(r *http.Request, id int) func() (interface{}, error) {
+    return func() (interface{}, error) {
+        current := Movie{ID: id}
+        err := a.Movies.GetMovie(r.Context(), &current)
+        return current, err
+    }
+}
+
+// currentCategory is currentMovie for categories.
+func (a *App) currentCategory(r *http.Request, id int) func() (interface{}, error) {
+    return func() (interface{}, error) {
+        current := Category{ID: id}
+        err := a.Categories.GetCategory(r.Context(), &current)
+        return current, err
+    }
+}
+
 // Catalog
 func (a *App) getMovieCatalog(w http.ResponseWriter, r *http.Request) {
-    catalog, err := getCategoriesWithMovies(a.DB)
+    var query CatalogQuery
+    // Checked in a fixed order, so a request with several bad parameters is
+    // always told about the same one.
+    for _, param := range []struct {
+        name string
+        target *int
+    }{
+        {"shelves", &query.Shelves},
+        {"per_shelf", &query.PerShelf},
+        {"after_shelf", &query.AfterShelf},
+    } {
+        if value := r.FormValue(param.name); value != "" {
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 1 {
+                respondWithError(w, r, http.StatusBadRequest, "Invalid " + param.name)
+                return
+            }
+            *param.target = n
+        }
+    }
+    if query.Shelves > 100 {
+        query.Shelves = 100
+    }
+    if query.PerShelf > 100 {
+        query.PerShelf = 100
+    }
+    query.OmitEmpty = r.FormValue("omit_empty") == "true"
+
+    // Key on the parsed query, so unknown parameters or spellings that parse
+    // alike can't multiply the entries.
+    key := catalogValues(query).Encode()
+    entry, generation, hit := a.catalog.get(key)
+    if hit {
+        w.Header().Set("X-Cache", "HIT")
+    } else {
+        var err error
+        entry, err = a.renderCatalog(r, query)
+        if err != nil {
+            respondWithStoreError(w, r, err)
+            return
+        }
+        a.catalog.put(key, generation, entry)
+        w.Header().Set("X-Cache", "MISS")
+    }
+
+    // Writes invalidate the server side cache at once, so clients must
+    // revalidate with the ETag rather than reuse a copy for the TTL.
+    w.Header().Set("Cache-Control", "no-cache")
+
+    if entry.link != "" {
+        w.Header().Set("Link", entry.link)
+    }
+    respondWithETag(w, r, entry.body, entry.etag)
+}
+
+// catalogValues renders query as the canonical /catalog query string.
+func catalogValues(query CatalogQuery) url.Values {
+    values := url.Values{}
+    if query.Shelves > 0 {
+        values.Set("shelves", strconv.Itoa(query.Shelves))
+    }
+    if query.PerShelf > 0 {
+        values.Set("per_shelf", strconv.Itoa(query.PerShelf))
+    }
+    if query.AfterShelf > 0 {
+        values.Set("after_shelf", strconv.Itoa(query.AfterShelf))
+    }
+    if query.OmitEmpty {
+        values.Set("omit_empty", "true")
+    }
+    return values
+}
+
+// renderCatalog loads and encodes one page of the catalog. The next link is
+// built from the canonical query, since the entry is shared by every request
+// that parses alike.
+func (a *App) renderCatalog(r *http.Request, query CatalogQuery) (cachedCatalog, error) {
+    page := *r.URL
+    page.RawQuery = catalogValues(query).Encode()
+
+    // Ask for one extra shelf and movie to learn whether more follow.
+    shelves, perShelf := query.Shelves, query.PerShelf
+    if shelves > 0 {
+        query.Shelves++
+    }
+    if perShelf > 0 {
+        query.PerShelf++
+    }
+
+    catalog, err := a.Categories.GetCatalog(r.Context(), query)
+    if err != nil {
+        return cachedCatalog{}, err
+    }
+
+    var entry cachedCatalog
+    if shelves > 0 && len(catalog) > shelves {
+        catalog = catalog[:shelves]
+        entry.link = pageLink(&page, "after_shelf", strconv.Itoa(catalog[shelves-1].ID), "next")
+    }
+    if perShelf > 0 {
+        for i := range catalog {
+            trimShelf(&catalog[i], perShelf)
+        }
+    }
+
+    entry.body, err = json.Marshal(catalog)
+    entry.etag = etagFor(entry.body)
+    return entry, err
+}
+
+// getCatalogShelf lazy-loads more of one shelf, following its next cursor.
+func (a *App) getCatalogShelf(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    id, err := strconv.Atoi(vars["id"])
+    if err != nil {
+        respondWithError(w, r, http.StatusBadRequest, "Invalid category ID")
+        return
+    }
+
+    perShelf, _ := strconv.Atoi(r.FormValue("per_shelf"))
+    if perShelf > 100 || perShelf < 1 {
+        perShelf = 20
+    }
+
+    query := MovieQuery{Category: id, Count: perShelf + 1, Sort: "id"}
+    if token := r.FormValue("after"); token != "" {
+        c, err := decodeCursor(token)
+        if err != nil {
+            respondWithError(w, r, http.StatusBadRequest, err.Error())
+            return
+        }
+        query.After = c.ID
+    }
+
+    c := Category{ID: id}
+    if err := a.Categories.GetCategory(r.Context(), &c); err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+
+    movies, err := a.Movies.GetMovies(r.Context(), query)
     if err != nil {
-        respondWithError(w, http.StatusInternalServerError, err.Error())
+        respondWithStoreError(w, r, err)
         return
     }
-    respondWithJSON(w, http.StatusOK, catalog)
+    for i := range movies {
+        movies[i].Category = 0
+    }
+
+    shelf := Catalog{ID: c.ID, Title: c.Title, Movies: movies}
+    trimShelf(&shelf, perShelf)
+    respondWithJSON(w, http.StatusOK, shelf)
+}
+
+// trimShelf cuts a shelf fetched with one extra movie down to perShelf and
+// points Next at the rest.
+func trimShelf(shelf *Catalog, perShelf int) {
+    if len(shelf.Movies) <= perShelf {
+        return
+    }
+    shelf.Movies = shelf.Movies[:perShelf]
+    shelf.Next = encodeCursor(movieCursor{ID: shelf.Movies[perShelf-1].ID, Sort: "id"})
 }
 
 // Response
-func respondWithError(w http.ResponseWriter, code int, message string) {
-    respondWithJSON(w, code, map[string]string{"error": message})
+
+// respondWithStoreError maps the errors a store returns to a problem with
+// a stable error code. Anything unexpected is logged, not echoed.
+func respondWithStoreError(w http.ResponseWriter, r *http.Request, err error) {
+    switch e := err.(type) {
+    case *NotFoundError:
+        respondWithProblem(w, r, problem{Status: http.StatusNotFound, Code: e.Code(), Detail: e.Error()})
+        return
+    case *ConflictError:
+        respondWithProblem(w, r, problem{Status: http.StatusConflict, Code: e.Code(), Detail: e.Error()})
+        return
+    case *ValidationError:
+        respondWithViolations(w, r, []fieldError{{Field: e.Field, Code: e.Code(), Message: e.Message}})
+        return
+    }
+
+    // Drivers report a fired context in their own words, such as pq's
+    // SQLSTATE 57014 or SQLite's "interrupted", so the request's context
+    // decides before the error itself does.
+    cause := r.Context().Err()
+    switch {
+    case cause == context.DeadlineExceeded || errors.Is(err, context.DeadlineExceeded):
+        respondWithProblem(w, r, problem{Status: http.StatusGatewayTimeout, Code: "timeout", Detail: "Request timed out"})
+    case cause == context.Canceled || errors.Is(err, context.Canceled):
+        respondWithProblem(w, r, problem{Status: http.StatusServiceUnavailable, Code: "canceled", Detail: "Request canceled"})
+    default:
+        respondWithInternalError(w, r, err)
+    }
+}
+
+// respondWithConflict answers a write based on a stale version with the
+// state it lost to, so the client can merge and retry.
+func respondWithConflict(w http.ResponseWriter, r *http.Request, load func() (interface{}, error)) {
+    current, err := load()
+    if err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+    respondWithProblem(w, r, problem{Status: http.StatusConflict, Code: errVersionConflict.Code(), Detail: errVersionConflict.Error(), Current: current})
+}
+
+// respondWithViolations answers 422 with every rejected field.
+func respondWithViolations(w http.ResponseWriter, r *http.Request, violations []fieldError) {
+    respondWithProblem(w, r, problem{
+        Status: http.StatusUnprocessableEntity,
+        Code: "validation_failed",
+        Detail: "The request has invalid fields",
+        Errors: violations,
+    })
+}
+
+func respondWithError(w http.ResponseWriter, r *http.Request, code int, message string) {
+    respondWithProblem(w, r, problem{Status: code, Detail: message})
 }
 
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
     response, _ := json.Marshal(payload)
+    respondWithRawJSON(w, code, response)
+}
+
+// respondWithRawJSON writes an already encoded JSON body.
+func respondWithRawJSON(w http.ResponseWriter, code int, response []byte) {
     w.Header().Set("Content-Type", "application/json")
 	enableCors(&w)
     w.WriteHeader(code)
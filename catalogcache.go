@@ -0,0 +1,110 @@
+package main
+
+import (
+    "expvar"
+    "sync"
+    "time"
+)
+
+// maxCatalogEntries bounds the catalog cache; each entry is a whole page.
+const maxCatalogEntries = 1000
+
+// Hit and miss counters for the catalog cache, served on /debug/vars.
+var (
+    catalogCacheHits = expvar.NewInt("catalog_cache_hits")
+    catalogCacheMisses = expvar.NewInt("catalog_cache_misses")
+)
+
+// cachedCatalog is a rendered /catalog response.
+type cachedCatalog struct {
+    body []byte
+    etag string
+    link string
+    expires time.Time
+}
+
+// catalogCache keeps rendered /catalog responses keyed by their canonical
+// query until the TTL passes or a write invalidates them, holding at most
+// maxCatalogEntries. A zero TTL disables it.
+type catalogCache struct {
+    mu sync.Mutex
+    ttl time.Duration
+    generation uint64
+    entries map[string]cachedCatalog
+}
+
+func newCatalogCache(ttl time.Duration) *catalogCache {
+    return &catalogCache{ttl: ttl, entries: map[string]cachedCatalog{}}
+}
+
+func (c *catalogCache) enabled() bool {
+    return c.ttl > 0
+}
+
+// get returns the live entry for key and the generation a caller building a
+// fresh entry must hand back to put.
+func (c *catalogCache) get(key string) (cachedCatalog, uint64, bool) {
+    if !c.enabled() {
+        return cachedCatalog{}, 0, false
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    entry, ok := c.entries[key]
+    if ok && time.Now().Before(entry.expires) {
+        catalogCacheHits.Add(1)
+        return entry, c.generation, true
+    }
+    if ok {
+        delete(c.entries, key)
+    }
+    catalogCacheMisses.Add(1)
+    return cachedCatalog{}, c.generation, false
+}
+
+// put stores entry unless a write invalidated the cache since the matching
+// get, in which case entry may already be stale.
+func (c *catalogCache) put(key string, generation uint64, entry cachedCatalog) {
+    if !c.enabled() {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    if generation != c.generation {
+        return
+    }
+    now := time.Now()
+    if _, ok := c.entries[key]; !ok && len(c.entries) >= maxCatalogEntries {
+        c.evict(now)
+    }
+    entry.expires = now.Add(c.ttl)
+    c.entries[key] = entry
+}
+
+// evict makes room for one entry: it sweeps the expired entries, and when
+// all are live drops an arbitrary one. Callers must hold c.mu.
+func (c *catalogCache) evict(now time.Time) {
+    for key, entry := range c.entries {
+        if !now.Before(entry.expires) {
+            delete(c.entries, key)
+        }
+    }
+    for key := range c.entries {
+        if len(c.entries) < maxCatalogEntries {
+            break
+        }
+        delete(c.entries, key)
+    }
+}
+
+// invalidate drops every entry; handlers call it after any catalog write.
+func (c *catalogCache) invalidate() {
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    c.generation++
+    c.entries = map[string]cachedCatalog{}
+}
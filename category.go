@@ -1,58 +1,68 @@
 package main
 
 import (
-    "fmt"
+    "context"
     "database/sql"
 )
 
 type Category struct {
     ID int `json:"id"`
     Title string `json:"titulo"`
+    // Version counts the writes to the category, as Movie.Version does.
+    Version int `json:"version"`
 }
 
 type Catalog struct {
     ID int `json:"id"`
     Title string `json:"titulo"`
     Movies []Movie `json:"filmes"`
+    // Next is the cursor for the shelf's following movies, if any.
+    Next string `json:"next,omitempty"`
 }
 
-func (c *Category) getCategory(db *sql.DB) error {
-    statement := fmt.Sprintf("SELECT title FROM categories WHERE id=%d", c.ID)
-    return db.QueryRow(statement).Scan(&c.Title)
+// CatalogQuery limits which shelves the catalog returns and how full they
+// are. Zero limits mean unbounded.
+type CatalogQuery struct {
+    Shelves int
+    // AfterShelf skips categories up to and including this ID.
+    AfterShelf int
+    PerShelf int
+    OmitEmpty bool
 }
 
-func (c *Category) updateCategory(db *sql.DB) error {
-    statement := fmt.Sprintf("UPDATE categories SET title='%s' WHERE id=%d", c.Title, c.ID)
-    _, err := db.Exec(statement)
+func (s *sqlStore) GetCategory(ctx context.Context, c *Category) error {
+    stmt, err := s.prepare(ctx, "SELECT title, version FROM categories WHERE id=?")
+    if err != nil {
+        return err
+    }
+    err = stmt.QueryRowContext(ctx, c.ID).Scan(&c.Title, &c.Version)
+    if err == sql.ErrNoRows {
+        return categoryNotFound(c.ID)
+    }
     return err
 }
 
-func (c *Category) deleteCategory(db *sql.DB) error {
-    statement := fmt.Sprintf("DELETE FROM categories WHERE id=%d", c.ID)
-    _, err := db.Exec(statement)
-    return err
+func (s *sqlStore) UpdateCategory(ctx context.Context, c *Category) error {
+    return s.update(ctx, "categories", "title=?", c.ID, &c.Version, categoryNotFound(c.ID), c.Title)
 }
 
-func (c *Category) createCategory(db *sql.DB) error {
-    statement := fmt.Sprintf("INSERT INTO categories(title) VALUES('%s')", c.Title)
+func (s *sqlStore) DeleteCategory(ctx context.Context, c *Category) error {
+    err := s.exec(ctx, categoryNotFound(c.ID), "DELETE FROM categories WHERE id=?", c.ID)
+    return s.foreignKey(err, errCategoryInUse)
+}
 
-    _, err := db.Exec(statement)
-    if err != nil {
-        return err
-    }
+func (s *sqlStore) CreateCategory(ctx context.Context, c *Category) error {
+    c.Version = 1
+    return s.insert(ctx, "INSERT INTO categories(title, version) VALUES(?, ?)", &c.ID, c.Title, c.Version)
+}
 
-    err = db.QueryRow("SELECT LAST_INSERT_ID()").Scan(&c.ID)
+func (s *sqlStore) GetCategories(ctx context.Context) ([]Category, error) {
+    stmt, err := s.prepare(ctx, "SELECT id, title, version FROM categories")
     if err != nil {
-        return err
+        return nil, err
     }
 
-    return nil
-}
-
-func getCategories(db *sql.DB) ([]Category, error) {
-    statement := fmt.Sprintf("SELECT id, title FROM categories")
-
-    rows, err := db.Query(statement)
+    rows, err := stmt.QueryContext(ctx)
     if err != nil {
         return nil, err
     }
@@ -61,7 +71,7 @@ func getCategories(db *sql.DB) ([]Category, error) {
     categories := []Category{}
     for rows.Next() {
         var c Category
-        if err := rows.Scan(&c.ID, &c.Title); err != nil {
+        if err := rows.Scan(&c.ID, &c.Title, &c.Version); err != nil {
             return nil, err
         }
         categories = append(categories, c)
@@ -70,23 +80,61 @@ func getCategories(db *sql.DB) ([]Category, error) {
     return categories, nil
 }
 
-func getCategoriesWithMovies(db *sql.DB) ([]Catalog, error) {
-    categories, err := getCategories(db)
-    catalogs := []Catalog{}
+// GetCatalog returns the requested shelves with their movies from a single
+// joined query, grouped here in Go.
+func (s *sqlStore) GetCatalog(ctx context.Context, query CatalogQuery) ([]Catalog, error) {
+    shelves := "SELECT id, title FROM categories c WHERE c.id > ?"
+    args := []interface{}{query.AfterShelf}
+    if query.OmitEmpty {
+        shelves += " AND EXISTS (SELECT 1 FROM movies e WHERE e.category_id = c.id)"
+    }
+    shelves += " ORDER BY c.id"
+    if query.Shelves > 0 {
+        shelves += " LIMIT ?"
+        args = append(args, query.Shelves)
+    }
 
+    movies := "movies"
+    if query.PerShelf > 0 {
+        // Window functions need MySQL 8, so rank movies within their shelf
+        // with a correlated count instead, counting only on the selected
+        // shelves. MySQL rejects LIMIT directly inside IN, hence the derived
+        // table around the shelves query.
+        movies = "(SELECT * FROM movies m WHERE m.category_id IN (SELECT id FROM (" + shelves + ") s) AND (SELECT COUNT(*) FROM movies p WHERE p.category_id = m.category_id AND p.id < m.id) < ?)"
+        args = append(args, args...)
+        args = append(args, query.PerShelf)
+    }
+
+    statement := "SELECT c.id, c.title, m.id, m.title, m.cover, m.description, m.version FROM (" + shelves + ") c LEFT JOIN " + movies + " m ON m.category_id = c.id ORDER BY c.id, m.id"
+    stmt, err := s.prepare(ctx, statement)
     if err != nil {
         return nil, err
     }
 
-    for _, element := range categories {
-        movies, err := getMoviesByCategoryId(db, element.ID)
+    rows, err := stmt.QueryContext(ctx, args...)
+    if err != nil {
+        return nil, err
+    }
 
-        if err != nil {
+    defer rows.Close()
+    catalogs := []Catalog{}
+    for rows.Next() {
+        var c Category
+        var id, version sql.NullInt64
+        var title, cover, description sql.NullString
+        if err := rows.Scan(&c.ID, &c.Title, &id, &title, &cover, &description, &version); err != nil {
             return nil, err
         }
 
-        catalogs = append(catalogs, Catalog{element.ID, element.Title, movies})
+        if len(catalogs) == 0 || catalogs[len(catalogs)-1].ID != c.ID {
+            catalogs = append(catalogs, Catalog{ID: c.ID, Title: c.Title, Movies: []Movie{}})
+        }
+        // A category without movies comes back as one row of NULLs.
+        if id.Valid {
+            shelf := &catalogs[len(catalogs)-1]
+            shelf.Movies = append(shelf.Movies, Movie{ID: int(id.Int64), Title: title.String, Cover: cover.String, Description: description.String, Version: int(version.Int64)})
+        }
     }
 
-    return catalogs, nil
+    return catalogs, rows.Err()
 }
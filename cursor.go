@@ -0,0 +1,161 @@
+package main
+
+import (
+    "encoding/base64"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "net/url"
+    "strings"
+)
+
+var errInvalidCursor = errors.New("Invalid cursor")
+
+// movieCursor is the decoded form of the opaque ?after= and ?before= tokens:
+// the boundary movie, its sort value and the order the listing was walked in.
+type movieCursor struct {
+    ID int `json:"i"`
+    Sort string `json:"s"`
+    Value string `json:"v,omitempty"`
+    Descending bool `json:"d,omitempty"`
+}
+
+// sortValue is the value of m that a listing sorted by sort orders it on,
+// or "" for id, which the cursor already carries.
+func sortValue(m Movie, sort string) string {
+    switch sort {
+    case "title":
+        return m.Title
+    case "created_at":
+        return m.CreatedAt
+    }
+    return ""
+}
+
+func encodeCursor(c movieCursor) string {
+    data, _ := json.Marshal(c)
+    return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(token string) (movieCursor, error) {
+    var c movieCursor
+
+    data, err := base64.RawURLEncoding.DecodeString(token)
+    if err != nil {
+        return c, errInvalidCursor
+    }
+    if err := json.Unmarshal(data, &c); err != nil || c.ID < 1 {
+        return c, errInvalidCursor
+    }
+    if _, ok := movieSortColumns[c.Sort]; !ok {
+        return c, errInvalidCursor
+    }
+
+    return c, nil
+}
+
+// moviePage is the response envelope of cursor paginated movie listings.
+type moviePage struct {
+    Movies []Movie `json:"filmes"`
+    Next string `json:"next,omitempty"`
+    Prev string `json:"prev,omitempty"`
+    Total *int `json:"total,omitempty"`
+}
+
+// getMoviePage serves GET /movies in cursor mode, which a request opts into by
+// sending ?after= or ?before= (empty for the first page).
+func (a *App) getMoviePage(w http.ResponseWriter, r *http.Request, query MovieQuery) {
+    values := r.URL.Query()
+    _, afterSet := values["after"]
+    _, beforeSet := values["before"]
+    if afterSet && beforeSet {
+        respondWithError(w, r, http.StatusBadRequest, "Only one of after and before may be set")
+        return
+    }
+
+    backwards := false
+    query.Start = 0
+    for _, name := range []string{"after", "before"} {
+        token := values.Get(name)
+        if token == "" {
+            continue
+        }
+        c, err := decodeCursor(token)
+        if err != nil {
+            respondWithError(w, r, http.StatusBadRequest, err.Error())
+            return
+        }
+        query.Sort = c.Sort
+        query.Descending = c.Descending
+        query.Boundary = c.Value
+        if name == "after" {
+            query.After = c.ID
+        } else {
+            query.Before = c.ID
+            backwards = true
+        }
+    }
+
+    // Ask for one extra movie to learn whether another page follows.
+    count := query.Count
+    query.Count = count + 1
+    movies, err := a.Movies.GetMovies(r.Context(), query)
+    if err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+
+    more := len(movies) > count
+    if more && backwards {
+        movies = movies[1:]
+    } else if more {
+        movies = movies[:count]
+    }
+
+    page := moviePage{Movies: movies}
+    if len(movies) > 0 {
+        cursor := func(m Movie) string {
+            return encodeCursor(movieCursor{ID: m.ID, Sort: query.Sort, Value: sortValue(m, query.Sort), Descending: query.Descending})
+        }
+        if (backwards && more) || (!backwards && query.After != 0) {
+            page.Prev = cursor(movies[0])
+        }
+        if backwards || more {
+            page.Next = cursor(movies[len(movies)-1])
+        }
+    }
+
+    if r.FormValue("total") == "true" {
+        total, err := a.Movies.CountMovies(r.Context(), query)
+        if err != nil {
+            respondWithStoreError(w, r, err)
+            return
+        }
+        page.Total = &total
+    }
+
+    links := []string{}
+    if page.Next != "" {
+        links = append(links, pageLink(r.URL, "after", page.Next, "next"))
+    }
+    if page.Prev != "" {
+        links = append(links, pageLink(r.URL, "before", page.Prev, "prev"))
+    }
+    if len(links) > 0 {
+        w.Header().Set("Link", strings.Join(links, ", "))
+    }
+
+    respondWithTaggedJSON(w, r, page)
+}
+
+// pageLink renders an RFC 8288 link to the same listing with a new cursor.
+func pageLink(current *url.URL, param, token, rel string) string {
+    values := current.Query()
+    values.Del("after")
+    values.Del("before")
+    values.Del("start")
+    values.Set(param, token)
+
+    target := url.URL{Path: current.Path, RawQuery: values.Encode()}
+    return "<" + target.String() + ">; rel=\"" + rel + "\""
+}
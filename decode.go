@@ -0,0 +1,106 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "mime"
+    "net/http"
+    "reflect"
+    "strings"
+)
+
+// defaultMaxBodyBytes caps request bodies when App.MaxBodyBytes is unset.
+const defaultMaxBodyBytes = 1 << 20
+
+// decodeJSON strictly decodes the request body into dst: the Content-Type
+// must be JSON, the body must fit in MaxBodyBytes, and it must hold exactly
+// one value with no fields dst doesn't know. On failure it answers 415, 413
+// or 400 and returns false. A missing Content-Type is read as JSON, since
+// older clients never sent one.
+func (a *App) decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) bool {
+    defer r.Body.Close()
+
+    if contentType := r.Header.Get("Content-Type"); contentType != "" {
+        mediaType, _, err := mime.ParseMediaType(contentType)
+        if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+            respondWithError(w, r, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+            return false
+        }
+    }
+
+    limit := a.MaxBodyBytes
+    if limit <= 0 {
+        limit = defaultMaxBodyBytes
+    }
+
+    decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit))
+    decoder.DisallowUnknownFields()
+    err := decoder.Decode(dst)
+    if err == nil {
+        // Anything but whitespace after the value is trailing data.
+        err = decoder.Decode(&struct{}{})
+        if err == io.EOF {
+            return true
+        }
+        if !bodyTooLarge(err) {
+            err = errTrailingData
+        }
+    }
+
+    if bodyTooLarge(err) {
+        respondWithError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("Request body must not be larger than %d bytes", limit))
+        return false
+    }
+    respondWithError(w, r, http.StatusBadRequest, decodeErrorMessage(err))
+    return false
+}
+
+// bodyTooLarge matches MaxBytesReader's error by its text, since the error
+// type is unexported before Go 1.19.
+func bodyTooLarge(err error) bool {
+    return err != nil && err.Error() == "http: request body too large"
+}
+
+var errTrailingData = errors.New("trailing data")
+
+// decodeErrorMessage explains a decoding failure without echoing the body.
+func decodeErrorMessage(err error) string {
+    var syntaxError *json.SyntaxError
+    var typeError *json.UnmarshalTypeError
+    switch {
+    case err == io.EOF:
+        return "Request body must not be empty"
+    case err == io.ErrUnexpectedEOF:
+        return "Request body contains truncated JSON"
+    case err == errTrailingData:
+        return "Request body must contain a single JSON value"
+    case errors.As(err, &syntaxError):
+        return fmt.Sprintf("Request body contains malformed JSON at position %d", syntaxError.Offset)
+    case errors.As(err, &typeError) && typeError.Field != "":
+        return fmt.Sprintf("Field %q must be a JSON %s", typeError.Field, jsonTypeName(typeError.Type))
+    case errors.As(err, &typeError):
+        return fmt.Sprintf("Request body must be a JSON %s", jsonTypeName(typeError.Type))
+    case strings.HasPrefix(err.Error(), "json: unknown field "):
+        return "Unknown field " + strings.TrimPrefix(err.Error(), "json: unknown field ")
+    }
+    return "Invalid request payload"
+}
+
+// jsonTypeName names the JSON type a Go type decodes from.
+func jsonTypeName(t reflect.Type) string {
+    switch t.Kind() {
+    case reflect.Bool:
+        return "boolean"
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+        reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+        reflect.Float32, reflect.Float64:
+        return "number"
+    case reflect.String:
+        return "string"
+    case reflect.Slice, reflect.Array:
+        return "array"
+    }
+    return "object"
+}
@@ -0,0 +1,72 @@
+package main
+
+// The stores report failures the client caused with these types, and
+// respondWithStoreError maps them to status codes. Code is a stable,
+// machine-readable identifier clients can switch on.
+
+// NotFoundError is returned when the addressed row does not exist.
+type NotFoundError struct {
+    Resource string
+    ID int
+}
+
+func (e *NotFoundError) Error() string {
+    switch e.Resource {
+    case "movie":
+        return "Movie not found"
+    case "category":
+        return "Category not found"
+    }
+    return "Resource not found"
+}
+
+func (e *NotFoundError) Code() string {
+    return e.Resource + "_not_found"
+}
+
+// ConflictError is returned when a write clashes with the stored state.
+type ConflictError struct {
+    Reason string
+    Message string
+}
+
+func (e *ConflictError) Error() string {
+    return e.Message
+}
+
+func (e *ConflictError) Code() string {
+    return e.Reason
+}
+
+// ValidationError is returned when a field holds a value the store rejects.
+type ValidationError struct {
+    Field string
+    Reason string
+    Message string
+}
+
+func (e *ValidationError) Error() string {
+    return e.Field + ": " + e.Message
+}
+
+func (e *ValidationError) Code() string {
+    return e.Reason
+}
+
+// errVersionConflict is returned by updates that carry a version the stored
+// row has already moved past.
+var errVersionConflict = &ConflictError{Reason: "version_conflict", Message: "Version conflict"}
+
+// errCategoryInUse is returned when deleting a category movies still reference.
+var errCategoryInUse = &ConflictError{Reason: "category_in_use", Message: "Category still has movies"}
+
+// errUnknownCategory is returned when a movie names a category that does not exist.
+var errUnknownCategory = &ValidationError{Field: "id_categoria", Reason: "unknown_category", Message: "Category does not exist"}
+
+func movieNotFound(id int) error {
+    return &NotFoundError{Resource: "movie", ID: id}
+}
+
+func categoryNotFound(id int) error {
+    return &NotFoundError{Resource: "category", ID: id}
+}
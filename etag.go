@@ -0,0 +1,90 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "net/http"
+    "strings"
+)
+
+// etagFor derives a strong entity tag from a rendered JSON body, so equal
+// representations always carry equal tags.
+func etagFor(body []byte) string {
+    sum := sha256.Sum256(body)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether etag is listed in an If-Match or If-None-Match
+// header. If-None-Match compares weakly (RFC 7232 section 3.2), so a W/
+// prefix is ignored there; If-Match compares strongly and never matches one.
+func etagMatches(header, etag string, weak bool) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimSpace(candidate)
+        if candidate == "*" {
+            return true
+        }
+        if weak {
+            candidate = strings.TrimPrefix(candidate, "W/")
+        }
+        if candidate == etag {
+            return true
+        }
+    }
+    return false
+}
+
+// respondWithETag writes body with its ETag, or a bare 304 when the client's
+// If-None-Match already holds it.
+func respondWithETag(w http.ResponseWriter, r *http.Request, body []byte, etag string) {
+    w.Header().Set("ETag", etag)
+    if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag, true) {
+        enableCors(&w)
+        w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    respondWithRawJSON(w, http.StatusOK, body)
+}
+
+// respondWithTaggedJSON renders payload and answers it through respondWithETag.
+func respondWithTaggedJSON(w http.ResponseWriter, r *http.Request, payload interface{}) {
+    body, _ := json.Marshal(payload)
+    respondWithETag(w, r, body, etagFor(body))
+}
+
+// respondWithUpdated writes a resource after a write, tagged as the next GET
+// of it will be.
+func respondWithUpdated(w http.ResponseWriter, payload interface{}) {
+    body, _ := json.Marshal(payload)
+    w.Header().Set("ETag", etagFor(body))
+    respondWithRawJSON(w, http.StatusOK, body)
+}
+
+// checkIfMatch enforces If-Match on a write. load reads the resource as GET
+// would render it; when the header is set and the current representation
+// does not match, or no longer exists, it answers 412 and returns false.
+// Otherwise it returns the representation that matched, nil without the
+// header, so the write can be pinned to its version.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, load func() (interface{}, error)) (interface{}, bool) {
+    header := r.Header.Get("If-Match")
+    if header == "" {
+        return nil, true
+    }
+
+    current, err := load()
+    if _, ok := err.(*NotFoundError); ok {
+        respondWithError(w, r, http.StatusPreconditionFailed, "Precondition failed")
+        return nil, false
+    }
+    if err != nil {
+        respondWithStoreError(w, r, err)
+        return nil, false
+    }
+
+    body, _ := json.Marshal(current)
+    if !etagMatches(header, etagFor(body), false) {
+        respondWithError(w, r, http.StatusPreconditionFailed, "Precondition failed")
+        return nil, false
+    }
+    return current, true
+}
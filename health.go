@@ -0,0 +1,127 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "log"
+    "net/http"
+    "time"
+)
+
+const (
+    connectAttempts = 10
+    connectInitialBackoff = 500 * time.Millisecond
+    connectMaxBackoff = 30 * time.Second
+    pingTimeout = 5 * time.Second
+)
+
+// readinessChecker is implemented by backends that depend on an external
+// server and can tell whether they are able to serve requests.
+type readinessChecker interface {
+    ready(ctx context.Context) error
+}
+
+// schemaBehindError counts the migrations the database is missing.
+type schemaBehindError int
+
+func (e schemaBehindError) Error() string {
+    return fmt.Sprintf("schema is %d migration(s) behind", int(e))
+}
+
+// ready reports whether the database answers and the schema is current.
+func (s *sqlStore) ready(ctx context.Context) error {
+    if err := s.db.PingContext(ctx); err != nil {
+        return err
+    }
+
+    pending, err := s.pendingMigrations(ctx)
+    if err != nil {
+        return err
+    }
+    if pending > 0 {
+        return schemaBehindError(pending)
+    }
+
+    return nil
+}
+
+// Connect waits for the database with a bounded exponential backoff, then
+// applies pending migrations when AUTO_MIGRATE is set and loads the search
+// index. It refuses to continue against an out-of-date schema otherwise.
+func (a *App) Connect() error {
+    if a.store == nil {
+        return nil
+    }
+
+    backoff := connectInitialBackoff
+    for attempt := 1; ; attempt++ {
+        ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+        err := a.store.db.PingContext(ctx)
+        cancel()
+        if err == nil {
+            break
+        }
+        if attempt == connectAttempts {
+            return fmt.Errorf("database unreachable after %d attempts: %v", attempt, err)
+        }
+
+        log.Printf("database unreachable (attempt %d/%d), retrying in %s: %v", attempt, connectAttempts, backoff, err)
+        time.Sleep(backoff)
+        backoff *= 2
+        if backoff > connectMaxBackoff {
+            backoff = connectMaxBackoff
+        }
+    }
+
+    if autoMigrate() {
+        if err := a.store.migrateUp(); err != nil {
+            return err
+        }
+    } else {
+        pending, err := a.store.pendingMigrations(context.Background())
+        if err != nil {
+            return err
+        }
+        if pending > 0 {
+            return fmt.Errorf("schema is %d migration(s) behind; run `movies-api migrate up` or set AUTO_MIGRATE=1", pending)
+        }
+    }
+
+    return a.buildIndex(context.Background())
+}
+
+// Health
+func (a *App) getHealth(w http.ResponseWriter, r *http.Request) {
+    respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (a *App) getReadiness(w http.ResponseWriter, r *http.Request) {
+    checked := map[interface{}]bool{}
+    for _, store := range []interface{}{a.Movies, a.Categories} {
+        checker, ok := store.(readinessChecker)
+        if !ok || checked[store] {
+            continue
+        }
+        checked[store] = true
+
+        if err := checker.ready(r.Context()); err != nil {
+            detail := "Database unreachable"
+            if _, ok := err.(schemaBehindError); ok {
+                detail = err.Error()
+            } else {
+                log.Printf("request %s: readiness: %v", requestID(r), err)
+            }
+            respondWithError(w, r, http.StatusServiceUnavailable, detail)
+            return
+        }
+
+        // Connect builds the autocomplete index last; until it's in,
+        // /autocomplete would answer from an empty index.
+        if !a.index.loaded() {
+            respondWithError(w, r, http.StatusServiceUnavailable, "Search index loading")
+            return
+        }
+    }
+
+    respondWithJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
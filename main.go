@@ -6,6 +6,11 @@ import (
 )
 
 func main() {
+    if len(os.Args) > 1 && os.Args[1] == "migrate" {
+        a := App{}
+        os.Exit(a.Migrate("root", "", "movies-api", os.Args[2:], os.Stdout))
+    }
+
     port := os.Getenv("PORT")
     if port == "" {
         port = "8081"
@@ -15,5 +20,13 @@ func main() {
 
     a := App{}
     a.Initialize("root", "", "movies-api")
+
+    // Serve /healthz and /readyz while the database comes up.
+    go func() {
+        if err := a.Connect(); err != nil {
+            log.Fatal(err)
+        }
+    }()
+
     a.Run(":" + port)
 }
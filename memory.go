@@ -0,0 +1,373 @@
+package main
+
+import (
+    "context"
+    "sort"
+    "strings"
+    "sync"
+)
+
+// memoryStore implements MovieStore and CategoryStore in process memory. It
+// mirrors the MySQL tables: auto-increment IDs, the movies.category_id
+// foreign key and LIMIT/OFFSET paging.
+type memoryStore struct {
+    mu sync.RWMutex
+    movies map[int]Movie
+    categories map[int]Category
+    nextMovieID int
+    nextCategoryID int
+}
+
+func newMemoryStore() *memoryStore {
+    s := &memoryStore{}
+    s.truncate()
+    return s
+}
+
+// truncate empties both tables and resets their auto-increment counters.
+func (s *memoryStore) truncate() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.movies = map[int]Movie{}
+    s.categories = map[int]Category{}
+    s.nextMovieID = 1
+    s.nextCategoryID = 1
+
+    return nil
+}
+
+// Movies
+func (s *memoryStore) GetMovie(ctx context.Context, m *Movie) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    stored, ok := s.movies[m.ID]
+    if !ok {
+        return movieNotFound(m.ID)
+    }
+    *m = stored
+    return nil
+}
+
+func (s *memoryStore) GetMovies(ctx context.Context, query MovieQuery) ([]Movie, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    descending := query.Descending != (query.Before != 0)
+    before := func(x, y Movie) bool {
+        if descending {
+            return movieLess(y, x, query.Sort)
+        }
+        return movieLess(x, y, query.Sort)
+    }
+
+    matches := s.filterMovies(query)
+    if boundary := query.After + query.Before; boundary != 0 {
+        // Compare against the values the cursor carries, so a boundary movie
+        // deleted since the last page still marks where this one starts.
+        b := Movie{ID: boundary, Title: query.Boundary}
+        rest := []Movie{}
+        for _, m := range matches {
+            if before(b, m) {
+                rest = append(rest, m)
+            }
+        }
+        matches = rest
+    }
+    sort.Slice(matches, func(i, j int) bool { return before(matches[i], matches[j]) })
+
+    movies := []Movie{}
+    for i, m := range matches {
+        if i < query.Start {
+            continue
+        }
+        if len(movies) == query.Count {
+            break
+        }
+        movies = append(movies, m)
+    }
+
+    if query.Before != 0 {
+        reverseMovies(movies)
+    }
+
+    return movies, nil
+}
+
+func (s *memoryStore) CountMovies(ctx context.Context, query MovieQuery) (int, error) {
+    if err := ctx.Err(); err != nil {
+        return 0, err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    return len(s.filterMovies(query)), nil
+}
+
+// filterMovies applies the category and search filters of query. Callers must
+// hold s.mu.
+func (s *memoryStore) filterMovies(query MovieQuery) []Movie {
+    search := strings.ToLower(query.Search)
+    matches := []Movie{}
+    for _, id := range s.movieIDs() {
+        m := s.movies[id]
+        if query.Category != 0 && m.Category != query.Category {
+            continue
+        }
+        if search != "" && !strings.Contains(strings.ToLower(m.Title), search) && !strings.Contains(strings.ToLower(m.Description), search) {
+            continue
+        }
+        matches = append(matches, m)
+    }
+
+    return matches
+}
+
+// movieLess orders movies by a movieSortColumns key with id as tie-breaker.
+// Titles compare lower-cased, like ORDER BY LOWER(title). IDs are handed out
+// in creation order, so created_at sorts like id.
+func movieLess(x, y Movie, field string) bool {
+    if field == "title" {
+        if a, b := strings.ToLower(x.Title), strings.ToLower(y.Title); a != b {
+            return a < b
+        }
+    }
+    return x.ID < y.ID
+}
+
+func (s *memoryStore) SearchMovies(ctx context.Context, q string, limit int) ([]SearchResult, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    terms := searchTerms(q)
+    results := []SearchResult{}
+    for _, id := range s.movieIDs() {
+        m := s.movies[id]
+        if score := scoreMovie(m, terms); score > 0 {
+            results = append(results, SearchResult{Movie: m, CategoryTitle: s.categories[m.Category].Title, Score: score})
+        }
+    }
+
+    return rankResults(results, limit), nil
+}
+
+func (s *memoryStore) CreateMovie(ctx context.Context, m *Movie) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.categories[m.Category]; !ok {
+        return errUnknownCategory
+    }
+
+    m.ID = s.nextMovieID
+    m.Version = 1
+    s.nextMovieID++
+    s.movies[m.ID] = *m
+
+    return nil
+}
+
+func (s *memoryStore) UpdateMovie(ctx context.Context, m *Movie) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, ok := s.movies[m.ID]
+    if !ok {
+        return movieNotFound(m.ID)
+    }
+    if m.Version != 0 && m.Version != stored.Version {
+        return errVersionConflict
+    }
+    if _, ok := s.categories[m.Category]; !ok {
+        return errUnknownCategory
+    }
+    m.Version = stored.Version + 1
+    s.movies[m.ID] = *m
+
+    return nil
+}
+
+func (s *memoryStore) DeleteMovie(ctx context.Context, m *Movie) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.movies[m.ID]; !ok {
+        return movieNotFound(m.ID)
+    }
+    delete(s.movies, m.ID)
+    return nil
+}
+
+// movieIDs returns the stored movie IDs in primary key order. Callers must
+// hold s.mu.
+func (s *memoryStore) movieIDs() []int {
+    ids := make([]int, 0, len(s.movies))
+    for id := range s.movies {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+    return ids
+}
+
+// Categories
+func (s *memoryStore) GetCategory(ctx context.Context, c *Category) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    stored, ok := s.categories[c.ID]
+    if !ok {
+        return categoryNotFound(c.ID)
+    }
+    *c = stored
+    return nil
+}
+
+func (s *memoryStore) GetCategories(ctx context.Context) ([]Category, error) {
+    if err := ctx.Err(); err != nil {
+        return nil, err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    ids := make([]int, 0, len(s.categories))
+    for id := range s.categories {
+        ids = append(ids, id)
+    }
+    sort.Ints(ids)
+
+    categories := []Category{}
+    for _, id := range ids {
+        categories = append(categories, s.categories[id])
+    }
+
+    return categories, nil
+}
+
+func (s *memoryStore) CreateCategory(ctx context.Context, c *Category) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    c.ID = s.nextCategoryID
+    c.Version = 1
+    s.nextCategoryID++
+    s.categories[c.ID] = *c
+
+    return nil
+}
+
+func (s *memoryStore) UpdateCategory(ctx context.Context, c *Category) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    stored, ok := s.categories[c.ID]
+    if !ok {
+        return categoryNotFound(c.ID)
+    }
+    if c.Version != 0 && c.Version != stored.Version {
+        return errVersionConflict
+    }
+    c.Version = stored.Version + 1
+    s.categories[c.ID] = *c
+
+    return nil
+}
+
+func (s *memoryStore) DeleteCategory(ctx context.Context, c *Category) error {
+    if err := ctx.Err(); err != nil {
+        return err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, ok := s.categories[c.ID]; !ok {
+        return categoryNotFound(c.ID)
+    }
+    for _, m := range s.movies {
+        if m.Category == c.ID {
+            return errCategoryInUse
+        }
+    }
+    delete(s.categories, c.ID)
+
+    return nil
+}
+
+// Catalog
+func (s *memoryStore) GetCatalog(ctx context.Context, query CatalogQuery) ([]Catalog, error) {
+    categories, err := s.GetCategories(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    s.mu.RLock()
+    defer s.mu.RUnlock()
+
+    shelves := map[int][]Movie{}
+    for _, id := range s.movieIDs() {
+        m := s.movies[id]
+        category := m.Category
+        if query.PerShelf > 0 && len(shelves[category]) == query.PerShelf {
+            continue
+        }
+        // The SQL backend doesn't select category_id for the catalog.
+        m.Category = 0
+        shelves[category] = append(shelves[category], m)
+    }
+
+    catalogs := []Catalog{}
+    for _, c := range categories {
+        if query.Shelves > 0 && len(catalogs) == query.Shelves {
+            break
+        }
+        movies := shelves[c.ID]
+        if c.ID <= query.AfterShelf || (query.OmitEmpty && len(movies) == 0) {
+            continue
+        }
+        if movies == nil {
+            movies = []Movie{}
+        }
+        catalogs = append(catalogs, Catalog{ID: c.ID, Title: c.Title, Movies: movies})
+    }
+
+    return catalogs, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+)
+
+// migration is one numbered schema change. Every dialect lists the same
+// versions in ascending order.
+type migration struct {
+    version int
+    name string
+    up []string
+    down []string
+}
+
+type migrationStatus struct {
+    migration
+    applied bool
+}
+
+const schemaMigrationsTableCreationQuery = `
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+    version INT NOT NULL PRIMARY KEY
+)`
+
+// ensureMigrationsTable creates schema_migrations. Only the paths that
+// migrate call it, so readiness checks never run DDL.
+func (s *sqlStore) ensureMigrationsTable(ctx context.Context) error {
+    _, err := s.db.ExecContext(ctx, schemaMigrationsTableCreationQuery)
+    return err
+}
+
+// appliedMigrations reads schema_migrations. A database without the table
+// has no migrations applied.
+func (s *sqlStore) appliedMigrations(ctx context.Context) (map[int]bool, error) {
+    rows, err := s.db.QueryContext(ctx, "SELECT version FROM schema_migrations")
+    if err != nil && s.dialect.undefinedTable(err) {
+        return map[int]bool{}, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+    applied := map[int]bool{}
+    for rows.Next() {
+        var version int
+        if err := rows.Scan(&version); err != nil {
+            return nil, err
+        }
+        applied[version] = true
+    }
+
+    return applied, rows.Err()
+}
+
+func (s *sqlStore) migrationStatus(ctx context.Context) ([]migrationStatus, error) {
+    applied, err := s.appliedMigrations(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    statuses := []migrationStatus{}
+    for _, m := range s.dialect.migrations {
+        statuses = append(statuses, migrationStatus{m, applied[m.version]})
+    }
+
+    return statuses, nil
+}
+
+// pendingMigrations returns how many migrations have not been applied yet.
+func (s *sqlStore) pendingMigrations(ctx context.Context) (int, error) {
+    statuses, err := s.migrationStatus(ctx)
+    if err != nil {
+        return 0, err
+    }
+
+    pending := 0
+    for _, status := range statuses {
+        if !status.applied {
+            pending++
+        }
+    }
+
+    return pending, nil
+}
+
+// withMigrationLock runs fn holding the dialect's advisory lock, so that
+// processes migrating at once, such as a release phase and a dyno with
+// AUTO_MIGRATE, take turns instead of applying a migration twice. The lock
+// belongs to a session, so it is taken and released on one connection.
+func (s *sqlStore) withMigrationLock(fn func() error) error {
+    if s.dialect.migrationLock == "" {
+        return fn()
+    }
+    if s.db.Stats().MaxOpenConnections == 1 {
+        return errors.New("migrating needs DB_MAX_OPEN_CONNS of at least 2, one for the lock")
+    }
+
+    ctx := context.Background()
+    conn, err := s.db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    var held sql.NullInt64
+    if err := conn.QueryRowContext(ctx, s.dialect.migrationLock).Scan(&held); err != nil {
+        return err
+    }
+    if held.Int64 != 1 {
+        return errors.New("timed out waiting for another migration to finish")
+    }
+
+    err = fn()
+    if _, unlockErr := conn.ExecContext(ctx, s.dialect.migrationUnlock); err == nil {
+        err = unlockErr
+    }
+    return err
+}
+
+// migrateUp applies every pending migration in version order.
+func (s *sqlStore) migrateUp() error {
+    return s.withMigrationLock(s.migrateUpLocked)
+}
+
+func (s *sqlStore) migrateUpLocked() error {
+    if err := s.ensureMigrationsTable(context.Background()); err != nil {
+        return err
+    }
+
+    statuses, err := s.migrationStatus(context.Background())
+    if err != nil {
+        return err
+    }
+
+    for _, status := range statuses {
+        if status.applied {
+            continue
+        }
+        if err := s.runMigration(status.up, "INSERT INTO schema_migrations(version) VALUES(?)", status.version); err != nil {
+            return fmt.Errorf("migration %d (%s): %v", status.version, status.name, err)
+        }
+    }
+
+    return nil
+}
+
+// migrateDown reverts the most recently applied migration, if any.
+func (s *sqlStore) migrateDown() error {
+    return s.withMigrationLock(s.migrateDownLocked)
+}
+
+func (s *sqlStore) migrateDownLocked() error {
+    if err := s.ensureMigrationsTable(context.Background()); err != nil {
+        return err
+    }
+
+    statuses, err := s.migrationStatus(context.Background())
+    if err != nil {
+        return err
+    }
+
+    for i := len(statuses) - 1; i >= 0; i-- {
+        status := statuses[i]
+        if !status.applied {
+            continue
+        }
+        if err := s.runMigration(status.down, "DELETE FROM schema_migrations WHERE version=?", status.version); err != nil {
+            return fmt.Errorf("migration %d (%s): %v", status.version, status.name, err)
+        }
+        return nil
+    }
+
+    return nil
+}
+
+// runMigration executes statements followed by the schema_migrations
+// bookkeeping in one transaction. MySQL commits DDL implicitly, so there a
+// failing migration can be left half applied.
+func (s *sqlStore) runMigration(statements []string, record string, version int) error {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+
+    for _, statement := range statements {
+        if _, err := tx.Exec(statement); err != nil {
+            tx.Rollback()
+            return err
+        }
+    }
+
+    if _, err := tx.Exec(s.rebind(record), version); err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+// Migrate runs the `migrate up|down|status` subcommand and returns the
+// process exit code.
+func (a *App) Migrate(user, password, dbname string, args []string, out io.Writer) int {
+    if len(args) != 1 {
+        fmt.Fprintln(out, "usage: movies-api migrate up|down|status")
+        return 2
+    }
+
+    store, err := a.openStore(user, password, dbname)
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return 1
+    }
+    a.store = store
+    defer a.Close()
+
+    switch args[0] {
+    case "up":
+        err = store.migrateUp()
+    case "down":
+        err = store.migrateDown()
+    case "status":
+        err = printMigrationStatus(store, out)
+    default:
+        fmt.Fprintln(out, "usage: movies-api migrate up|down|status")
+        return 2
+    }
+
+    if err != nil {
+        fmt.Fprintln(out, err)
+        return 1
+    }
+
+    return 0
+}
+
+func printMigrationStatus(store *sqlStore, out io.Writer) error {
+    statuses, err := store.migrationStatus(context.Background())
+    if err != nil {
+        return err
+    }
+
+    for _, status := range statuses {
+        state := "pending"
+        if status.applied {
+            state = "applied"
+        }
+        fmt.Fprintf(out, "%04d %-40s %s\n", status.version, status.name, state)
+    }
+
+    return nil
+}
+
+// autoMigrate reports whether the server may bring the schema up to date on
+// start instead of refusing to run.
+func autoMigrate() bool {
+    return os.Getenv("AUTO_MIGRATE") != ""
+}
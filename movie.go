@@ -1,8 +1,11 @@
 package main
 
 import (
-    "fmt"
+    "context"
     "database/sql"
+    "fmt"
+    "strings"
+    "time"
 )
 
 type Movie struct {
@@ -11,45 +14,135 @@ type Movie struct {
     Cover string `json:"imagem"`
     Category int `json:"id_categoria"`
     Description string `json:"descricao"`
+    // Version counts the writes to the movie; updates that carry it only
+    // apply on top of that exact version.
+    Version int `json:"version"`
+    // CreatedAt is the creation time as GetMovies reads it, kept out of the
+    // JSON and only carried in cursors.
+    CreatedAt string `json:"-"`
 }
 
-func (m *Movie) getMovie(db *sql.DB) error {
-    statement := fmt.Sprintf("SELECT title, cover, category_id, description FROM movies WHERE id=%d", m.ID)
-    return db.QueryRow(statement).Scan(&m.Title, &m.Cover, &m.Category, &m.Description)
+// MovieQuery filters, orders and pages a movie listing.
+type MovieQuery struct {
+    Start int
+    Count int
+    // Category restricts the listing to one category when non-zero.
+    Category int
+    // Search is a case-insensitive substring of the title or description.
+    Search string
+    // Sort is a key of movieSortColumns.
+    Sort string
+    Descending bool
+    // After and Before are keyset boundaries: the ID of the movie the page
+    // starts after or ends before. At most one is set.
+    After int
+    Before int
+    // Boundary is that movie's sort value, carried in the cursor so the page
+    // still has a place to start once the movie is deleted.
+    Boundary string
 }
 
-func (m *Movie) updateMovie(db *sql.DB) error {
-    statement := fmt.Sprintf("UPDATE movies SET title='%s', cover='%s', category_id=%d, description='%s' WHERE id=%d", m.Title, m.Cover, m.Category, m.Description, m.ID)
-    _, err := db.Exec(statement)
-    return err
+// movieSortColumns maps the accepted ?sort= values to the expressions the
+// listing orders by. Titles sort by LOWER(title) rather than by whatever the
+// database's collation does, so every backend and movieLess agree.
+var movieSortColumns = map[string]string{
+    "id": "id",
+    "title": "LOWER(title)",
+    "created_at": "created_at",
 }
 
-func (m *Movie) deleteMovie(db *sql.DB) error {
-    statement := fmt.Sprintf("DELETE FROM movies WHERE id=%d", m.ID)
-    _, err := db.Exec(statement)
-    return err
-}
+// likeEscaper escapes LIKE wildcards with the ! escape character.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
 
-func (m *Movie) createMovie(db *sql.DB) error {
-    statement := fmt.Sprintf("INSERT INTO movies(title, cover, category_id, description) VALUES('%s', '%s', %d, '%s')", m.Title, m.Cover, m.Category, m.Description)
-
-    _, err := db.Exec(statement)
+func (s *sqlStore) GetMovie(ctx context.Context, m *Movie) error {
+    stmt, err := s.prepare(ctx, "SELECT title, cover, category_id, description, version FROM movies WHERE id=?")
     if err != nil {
         return err
     }
+    err = stmt.QueryRowContext(ctx, m.ID).Scan(&m.Title, &m.Cover, &m.Category, &m.Description, &m.Version)
+    if err == sql.ErrNoRows {
+        return movieNotFound(m.ID)
+    }
+    return err
+}
 
-    err = db.QueryRow("SELECT LAST_INSERT_ID()").Scan(&m.ID)
-    if err != nil {
-        return err
+func (s *sqlStore) UpdateMovie(ctx context.Context, m *Movie) error {
+    err := s.update(ctx, "movies", "title=?, cover=?, category_id=?, description=?", m.ID, &m.Version, movieNotFound(m.ID), m.Title, m.Cover, m.Category, m.Description)
+    return s.foreignKey(err, errUnknownCategory)
+}
+
+func (s *sqlStore) DeleteMovie(ctx context.Context, m *Movie) error {
+    return s.exec(ctx, movieNotFound(m.ID), "DELETE FROM movies WHERE id=?", m.ID)
+}
+
+func (s *sqlStore) CreateMovie(ctx context.Context, m *Movie) error {
+    m.Version = 1
+    err := s.insert(ctx, "INSERT INTO movies(title, cover, category_id, description, created_at, version) VALUES(?, ?, ?, ?, CURRENT_TIMESTAMP, ?)", &m.ID, m.Title, m.Cover, m.Category, m.Description, m.Version)
+    return s.foreignKey(err, errUnknownCategory)
+}
+
+// movieFilters builds the WHERE conditions shared by GetMovies and CountMovies.
+func movieFilters(query MovieQuery) ([]string, []interface{}) {
+    conditions := []string{}
+    args := []interface{}{}
+
+    if query.Category != 0 {
+        conditions = append(conditions, "category_id = ?")
+        args = append(args, query.Category)
+    }
+    if query.Search != "" {
+        pattern := "%" + likeEscaper.Replace(strings.ToLower(query.Search)) + "%"
+        conditions = append(conditions, "(LOWER(title) LIKE ? ESCAPE '!' OR LOWER(description) LIKE ? ESCAPE '!')")
+        args = append(args, pattern, pattern)
     }
 
-    return nil
+    return conditions, args
 }
 
-func getMovies(db *sql.DB, start, count int) ([]Movie, error) {
-    statement := fmt.Sprintf("SELECT id, title, cover, category_id, description FROM movies LIMIT %d OFFSET %d", count, start)
+func (s *sqlStore) GetMovies(ctx context.Context, query MovieQuery) ([]Movie, error) {
+    statement := "SELECT id, title, cover, category_id, description, version, created_at FROM movies"
+    conditions, args := movieFilters(query)
+
+    // Keyset pages walk backwards from Before, so flip the order and reverse
+    // the rows afterwards.
+    descending := query.Descending != (query.Before != 0)
+    column := movieSortColumns[query.Sort]
+    if boundary := query.After + query.Before; boundary != 0 {
+        operator := ">"
+        if descending {
+            operator = "<"
+        }
+        if column == "id" {
+            conditions = append(conditions, "id " + operator + " ?")
+            args = append(args, boundary)
+        } else {
+            // The carried value goes through the same expression as the column.
+            value := "?"
+            if query.Sort == "title" {
+                value = "LOWER(?)"
+            }
+            conditions = append(conditions, fmt.Sprintf("(%s %s %s OR (%s = %s AND id %s ?))", column, operator, value, column, value, operator))
+            args = append(args, query.Boundary, query.Boundary, boundary)
+        }
+    }
+
+    if len(conditions) > 0 {
+        statement += " WHERE " + strings.Join(conditions, " AND ")
+    }
+
+    direction := "ASC"
+    if descending {
+        direction = "DESC"
+    }
+    statement += fmt.Sprintf(" ORDER BY %s %s, id %s LIMIT ? OFFSET ?", column, direction, direction)
+    args = append(args, query.Count, query.Start)
+
+    stmt, err := s.prepare(ctx, statement)
+    if err != nil {
+        return nil, err
+    }
 
-    rows, err := db.Query(statement)
+    rows, err := stmt.QueryContext(ctx, args...)
     if err != nil {
         return nil, err
     }
@@ -58,32 +151,119 @@ func getMovies(db *sql.DB, start, count int) ([]Movie, error) {
     movies := []Movie{}
     for rows.Next() {
         var m Movie
-        if err := rows.Scan(&m.ID, &m.Title, &m.Cover, &m.Category, &m.Description); err != nil {
+        if err := rows.Scan(&m.ID, &m.Title, &m.Cover, &m.Category, &m.Description, &m.Version, timestampText{&m.CreatedAt}); err != nil {
             return nil, err
         }
         movies = append(movies, m)
     }
 
-    return movies, nil
+    if query.Before != 0 {
+        reverseMovies(movies)
+    }
+
+    return movies, rows.Err()
+}
+
+// timestampText scans a TIMESTAMP column as "2006-01-02 15:04:05" text,
+// which every dialect compares against the column, whether the driver hands
+// back a time.Time or the raw text.
+type timestampText struct {
+    text *string
+}
+
+func (t timestampText) Scan(src interface{}) error {
+    switch v := src.(type) {
+    case time.Time:
+        *t.text = v.Format("2006-01-02 15:04:05.999999")
+    case []byte:
+        *t.text = string(v)
+    case string:
+        *t.text = v
+    case nil:
+        *t.text = ""
+    default:
+        return fmt.Errorf("cannot scan %T into a timestamp", src)
+    }
+    return nil
+}
+
+func (s *sqlStore) CountMovies(ctx context.Context, query MovieQuery) (int, error) {
+    statement := "SELECT COUNT(*) FROM movies"
+    conditions, args := movieFilters(query)
+    if len(conditions) > 0 {
+        statement += " WHERE " + strings.Join(conditions, " AND ")
+    }
+
+    stmt, err := s.prepare(ctx, statement)
+    if err != nil {
+        return 0, err
+    }
+
+    var count int
+    err = stmt.QueryRowContext(ctx, args...).Scan(&count)
+    return count, err
 }
 
-func getMoviesByCategoryId(db *sql.DB, category int) ([]Movie, error) {
-    statement := fmt.Sprintf("SELECT id, title, cover, description FROM movies WHERE category_id = %d", category)
+// SearchMovies ranks movies by relevance to q over title and description,
+// using the FULLTEXT index where the dialect has one.
+func (s *sqlStore) SearchMovies(ctx context.Context, q string, limit int) ([]SearchResult, error) {
+    terms := searchTerms(q)
+    if len(terms) == 0 {
+        return []SearchResult{}, nil
+    }
+
+    statement := "SELECT m.id, m.title, m.cover, m.category_id, m.description, m.version, c.title FROM movies m JOIN categories c ON c.id = m.category_id"
+    args := []interface{}{}
+    if s.dialect.fullText {
+        statement = "SELECT m.id, m.title, m.cover, m.category_id, m.description, m.version, c.title, MATCH(m.title, m.description) AGAINST (? IN NATURAL LANGUAGE MODE) AS score FROM movies m JOIN categories c ON c.id = m.category_id" +
+            " WHERE MATCH(m.title, m.description) AGAINST (? IN NATURAL LANGUAGE MODE) ORDER BY score DESC, m.id LIMIT ?"
+        args = append(args, q, q, limit)
+    } else {
+        // Without an index, narrow the candidates with LIKE and rank in Go.
+        conditions := []string{}
+        for _, term := range terms {
+            pattern := "%" + likeEscaper.Replace(term) + "%"
+            conditions = append(conditions, "LOWER(m.title) LIKE ? ESCAPE '!' OR LOWER(m.description) LIKE ? ESCAPE '!'")
+            args = append(args, pattern, pattern)
+        }
+        statement += " WHERE " + strings.Join(conditions, " OR ")
+    }
+
+    stmt, err := s.prepare(ctx, statement)
+    if err != nil {
+        return nil, err
+    }
 
-    rows, err := db.Query(statement)
+    rows, err := stmt.QueryContext(ctx, args...)
     if err != nil {
         return nil, err
     }
 
     defer rows.Close()
-    movies := []Movie{}
+    results := []SearchResult{}
     for rows.Next() {
-        var m Movie
-        if err := rows.Scan(&m.ID, &m.Title, &m.Cover, &m.Description); err != nil {
+        var r SearchResult
+        dest := []interface{}{&r.ID, &r.Title, &r.Cover, &r.Category, &r.Description, &r.Version, &r.CategoryTitle}
+        if s.dialect.fullText {
+            dest = append(dest, &r.Score)
+        }
+        if err := rows.Scan(dest...); err != nil {
             return nil, err
         }
-        movies = append(movies, m)
+        if !s.dialect.fullText {
+            r.Score = scoreMovie(r.Movie, terms)
+        }
+        results = append(results, r)
+    }
+    if err := rows.Err(); err != nil {
+        return nil, err
     }
 
-    return movies, nil
+    return rankResults(results, limit), nil
+}
+
+func reverseMovies(movies []Movie) {
+    for i, j := 0, len(movies)-1; i < j; i, j = i+1, j-1 {
+        movies[i], movies[j] = movies[j], movies[i]
+    }
 }
@@ -0,0 +1,54 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+)
+
+// mergePatch applies an RFC 7396 JSON Merge Patch to target: members of an
+// object patch replace the target's, null members delete them, and any
+// other patch value replaces the target outright.
+func mergePatch(target, patch interface{}) interface{} {
+    patchObject, ok := patch.(map[string]interface{})
+    if !ok {
+        return patch
+    }
+
+    targetObject, ok := target.(map[string]interface{})
+    if !ok {
+        targetObject = map[string]interface{}{}
+    }
+    for name, value := range patchObject {
+        if value == nil {
+            delete(targetObject, name)
+            continue
+        }
+        targetObject[name] = mergePatch(targetObject[name], value)
+    }
+
+    return targetObject
+}
+
+// applyMergePatch merges patch into the JSON rendering of current and
+// decodes the result into result. Deleted members come back as zero values,
+// and members result has no field for are an error.
+func applyMergePatch(current interface{}, patch map[string]interface{}, result interface{}) error {
+    body, err := json.Marshal(current)
+    if err != nil {
+        return err
+    }
+
+    var document interface{}
+    if err := json.Unmarshal(body, &document); err != nil {
+        return err
+    }
+
+    body, err = json.Marshal(mergePatch(document, patch))
+    if err != nil {
+        return err
+    }
+
+    decoder := json.NewDecoder(bytes.NewReader(body))
+    decoder.DisallowUnknownFields()
+    return decoder.Decode(result)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+    "database/sql"
+    "fmt"
+    "os"
+    "strconv"
+    "time"
+)
+
+// poolConfig sizes the database/sql connection pool.
+type poolConfig struct {
+    maxOpenConns int
+    maxIdleConns int
+    connMaxLifetime time.Duration
+    connMaxIdleTime time.Duration
+}
+
+// poolConfigFromEnv reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS,
+// DB_CONN_MAX_LIFETIME and DB_CONN_MAX_IDLE_TIME, keeping the defaults for
+// anything unset.
+func poolConfigFromEnv() (poolConfig, error) {
+    c := poolConfig{
+        maxOpenConns: 10,
+        maxIdleConns: 5,
+        connMaxLifetime: 30 * time.Minute,
+        connMaxIdleTime: 5 * time.Minute,
+    }
+
+    for name, target := range map[string]*int{
+        "DB_MAX_OPEN_CONNS": &c.maxOpenConns,
+        "DB_MAX_IDLE_CONNS": &c.maxIdleConns,
+    } {
+        if value := os.Getenv(name); value != "" {
+            n, err := strconv.Atoi(value)
+            if err != nil || n < 0 {
+                return c, fmt.Errorf("%s: expected a non-negative integer, got %q", name, value)
+            }
+            *target = n
+        }
+    }
+
+    for name, target := range map[string]*time.Duration{
+        "DB_CONN_MAX_LIFETIME": &c.connMaxLifetime,
+        "DB_CONN_MAX_IDLE_TIME": &c.connMaxIdleTime,
+    } {
+        if value := os.Getenv(name); value != "" {
+            d, err := time.ParseDuration(value)
+            if err != nil {
+                return c, fmt.Errorf("%s: %v", name, err)
+            }
+            *target = d
+        }
+    }
+
+    return c, nil
+}
+
+func (c poolConfig) apply(db *sql.DB) {
+    db.SetMaxOpenConns(c.maxOpenConns)
+    db.SetMaxIdleConns(c.maxIdleConns)
+    db.SetConnMaxLifetime(c.connMaxLifetime)
+    db.SetConnMaxIdleTime(c.connMaxIdleTime)
+}
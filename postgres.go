@@ -0,0 +1,83 @@
+package main
+
+import (
+    "github.com/lib/pq"
+)
+
+var postgresDialect = dialect{
+    driver: "postgres",
+    migrations: []migration{
+        {
+            version: 1,
+            name: "create_categories_and_movies",
+            up: []string{
+                `CREATE TABLE IF NOT EXISTS categories
+                (
+                    id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+                    title VARCHAR(50) NOT NULL
+                )`,
+                `CREATE TABLE IF NOT EXISTS movies
+                (
+                    id INT GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
+                    title VARCHAR(120) NOT NULL,
+                    cover VARCHAR(255),
+                    category_id INT NOT NULL REFERENCES categories(id),
+                    description TEXT
+                )`,
+            },
+            down: []string{
+                "DROP TABLE movies",
+                "DROP TABLE categories",
+            },
+        },
+        {
+            version: 2,
+            name: "add_movies_created_at",
+            up: []string{
+                "ALTER TABLE movies ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP",
+            },
+            down: []string{
+                "ALTER TABLE movies DROP COLUMN created_at",
+            },
+        },
+        {
+            version: 3,
+            name: "add_movies_fulltext_index",
+            // No full-text index here; SearchMovies falls back to LIKE.
+        },
+        {
+            version: 4,
+            name: "add_version_columns",
+            up: []string{
+                "ALTER TABLE movies ADD COLUMN version INT NOT NULL DEFAULT 1",
+                "ALTER TABLE categories ADD COLUMN version INT NOT NULL DEFAULT 1",
+            },
+            down: []string{
+                "ALTER TABLE movies DROP COLUMN version",
+                "ALTER TABLE categories DROP COLUMN version",
+            },
+        },
+    },
+    returningID: true,
+    numberedPlaceholders: true,
+    foreignKeyViolation: postgresForeignKeyViolation,
+    undefinedTable: postgresUndefinedTable,
+    // 7201 is an arbitrary key reserved for movies-api migrations.
+    migrationLock: "SELECT 1 FROM pg_advisory_lock(7201)",
+    migrationUnlock: "SELECT pg_advisory_unlock(7201)",
+    truncate: []string{
+        "TRUNCATE movies, categories RESTART IDENTITY",
+    },
+}
+
+// postgresForeignKeyViolation matches SQLSTATE 23503, foreign_key_violation.
+func postgresForeignKeyViolation(err error) bool {
+    e, ok := err.(*pq.Error)
+    return ok && e.Code == "23503"
+}
+
+// postgresUndefinedTable matches SQLSTATE 42P01, undefined_table.
+func postgresUndefinedTable(err error) bool {
+    e, ok := err.(*pq.Error)
+    return ok && e.Code == "42P01"
+}
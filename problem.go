@@ -0,0 +1,118 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "log"
+    "net/http"
+)
+
+// problem is an RFC 7807 problem details object. Code, Errors, Current and
+// CorrelationID are extension members.
+type problem struct {
+    Type string `json:"type"`
+    Title string `json:"title"`
+    Status int `json:"status"`
+    Detail string `json:"detail,omitempty"`
+    Instance string `json:"instance,omitempty"`
+    Code string `json:"code,omitempty"`
+    // Errors lists every rejected field of a 422.
+    Errors []fieldError `json:"errors,omitempty"`
+    // Current is the stored state a conflicting write lost to.
+    Current interface{} `json:"current,omitempty"`
+    // CorrelationID finds the server log entry of an internal error.
+    CorrelationID string `json:"correlation_id,omitempty"`
+}
+
+type fieldError struct {
+    Field string `json:"field"`
+    Code string `json:"code"`
+    Message string `json:"message"`
+}
+
+// problemTypeBase prefixes an error code to form the problem's type URI.
+const problemTypeBase = "urn:movies-api:problem:"
+
+func respondWithProblem(w http.ResponseWriter, r *http.Request, p problem) {
+    p.Type = "about:blank"
+    if p.Code != "" {
+        p.Type = problemTypeBase + p.Code
+    }
+    p.Title = http.StatusText(p.Status)
+    p.Instance = r.URL.RequestURI()
+
+    response, _ := json.Marshal(p)
+    w.Header().Set("Content-Type", "application/problem+json")
+    enableCors(&w)
+    w.WriteHeader(p.Status)
+    w.Write(response)
+}
+
+// respondWithInternalError logs err under the request's correlation ID and
+// answers a 500 that carries only the ID.
+func respondWithInternalError(w http.ResponseWriter, r *http.Request, err error) {
+    id := requestID(r)
+    log.Printf("request %s: %s %s: %v", id, r.Method, r.URL.Path, err)
+    respondWithProblem(w, r, problem{Status: http.StatusInternalServerError, Code: "internal", Detail: "An internal error occurred", CorrelationID: id})
+}
+
+type contextKey int
+
+const requestIDKey contextKey = iota
+
+// requestIDMiddleware tags each request with a correlation ID, taken from a
+// well-formed X-Request-ID header or generated, and echoes it back.
+func requestIDMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !validRequestID(id) {
+            id = newRequestID()
+        }
+
+        w.Header().Set("X-Request-ID", id)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+    })
+}
+
+// notFound answers requests no route matches.
+func notFound(w http.ResponseWriter, r *http.Request) {
+    respondWithError(w, r, http.StatusNotFound, "No resource at " + r.URL.Path)
+}
+
+// methodNotAllowed answers requests for a known path with a method it lacks.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+    respondWithError(w, r, http.StatusMethodNotAllowed, "Method " + r.Method + " is not allowed here")
+}
+
+// requestID returns the request's correlation ID, generating one for
+// requests that bypassed requestIDMiddleware.
+func requestID(r *http.Request) string {
+    if id, ok := r.Context().Value(requestIDKey).(string); ok {
+        return id
+    }
+    return newRequestID()
+}
+
+func newRequestID() string {
+    id := make([]byte, 8)
+    rand.Read(id)
+    return hex.EncodeToString(id)
+}
+
+// validRequestID accepts short IDs of letters, digits, '-', '_' and '.', so
+// client input can't forge log lines.
+func validRequestID(id string) bool {
+    if id == "" || len(id) > 64 {
+        return false
+    }
+    for _, c := range id {
+        switch {
+        case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+        default:
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+    "html"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "unicode/utf8"
+)
+
+const snippetLength = 160
+
+// SearchResult is a movie ranked against a search query.
+type SearchResult struct {
+    Movie
+    CategoryTitle string `json:"categoria"`
+    Score float64 `json:"relevancia"`
+    Snippet string `json:"trecho"`
+}
+
+// searchTerms splits a query into the lower-cased words it matches on.
+func searchTerms(q string) []string {
+    terms := []string{}
+    for _, term := range strings.Fields(strings.ToLower(q)) {
+        if len(terms) == 10 {
+            break
+        }
+        terms = append(terms, term)
+    }
+    return terms
+}
+
+// scoreMovie is the relevance used by backends without full-text indexes:
+// every occurrence of a term counts, and title hits count double.
+func scoreMovie(m Movie, terms []string) float64 {
+    title := strings.ToLower(m.Title)
+    description := strings.ToLower(m.Description)
+
+    score := 0.0
+    for _, term := range terms {
+        score += 2 * float64(strings.Count(title, term))
+        score += float64(strings.Count(description, term))
+    }
+    return score
+}
+
+// rankResults orders results by descending score, then by ID, and keeps the
+// first limit.
+func rankResults(results []SearchResult, limit int) []SearchResult {
+    sort.SliceStable(results, func(i, j int) bool {
+        if results[i].Score != results[j].Score {
+            return results[i].Score > results[j].Score
+        }
+        return results[i].ID < results[j].ID
+    })
+
+    if len(results) > limit {
+        results = results[:limit]
+    }
+    return results
+}
+
+// highlight returns a window of text around the first term it contains, with
+// every term occurrence wrapped in <mark> and the rest HTML-escaped. It
+// returns "" when no term occurs.
+func highlight(text string, terms []string) string {
+    lower := strings.ToLower(text)
+    // Lower-casing can change byte lengths outside ASCII; give up on
+    // highlighting rather than cut runes in half.
+    if len(lower) != len(text) {
+        return ""
+    }
+
+    first := -1
+    for _, term := range terms {
+        if i := strings.Index(lower, term); i >= 0 && (first < 0 || i < first) {
+            first = i
+        }
+    }
+    if first < 0 {
+        return ""
+    }
+
+    start := first - snippetLength/2
+    if start < 0 {
+        start = 0
+    }
+    end := start + snippetLength
+    if end > len(text) {
+        end = len(text)
+    }
+    for start > 0 && !utf8.RuneStart(text[start]) {
+        start--
+    }
+    for end < len(text) && !utf8.RuneStart(text[end]) {
+        end++
+    }
+
+    var b strings.Builder
+    if start > 0 {
+        b.WriteString("…")
+    }
+    // Only the <mark> tags are markup; everything taken from the movie is
+    // escaped, since clients render the snippet as HTML.
+    plain := start
+    for i := start; i < end; {
+        matched := ""
+        for _, term := range terms {
+            if strings.HasPrefix(lower[i:end], term) && len(term) > len(matched) {
+                matched = term
+            }
+        }
+        if matched == "" {
+            i++
+            continue
+        }
+        b.WriteString(html.EscapeString(text[plain:i]))
+        b.WriteString("<mark>" + html.EscapeString(text[i:i+len(matched)]) + "</mark>")
+        i += len(matched)
+        plain = i
+    }
+    b.WriteString(html.EscapeString(text[plain:end]))
+    if end < len(text) {
+        b.WriteString("…")
+    }
+
+    return b.String()
+}
+
+// Search
+func (a *App) search(w http.ResponseWriter, r *http.Request) {
+    q := strings.TrimSpace(r.FormValue("q"))
+    if q == "" {
+        respondWithError(w, r, http.StatusBadRequest, "Missing search query")
+        return
+    }
+
+    count, _ := strconv.Atoi(r.FormValue("count"))
+    if count > 20 || count < 1 {
+        count = 20
+    }
+
+    results, err := a.Movies.SearchMovies(r.Context(), q, count)
+    if err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+
+    terms := searchTerms(q)
+    for i := range results {
+        results[i].Snippet = highlight(results[i].Description, terms)
+        if results[i].Snippet == "" {
+            results[i].Snippet = highlight(results[i].Title, terms)
+        }
+    }
+
+    categories, err := a.Categories.GetCategories(r.Context())
+    if err != nil {
+        respondWithStoreError(w, r, err)
+        return
+    }
+
+    matching := []Category{}
+    for _, c := range categories {
+        title := strings.ToLower(c.Title)
+        for _, term := range terms {
+            if strings.Contains(title, term) {
+                matching = append(matching, c)
+                break
+            }
+        }
+    }
+
+    respondWithJSON(w, http.StatusOK, map[string]interface{}{"filmes": results, "categorias": matching})
+}
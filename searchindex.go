@@ -0,0 +1,373 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "unicode"
+
+    "golang.org/x/text/unicode/norm"
+)
+
+// movieIndex is an in-process, typo-tolerant and accent-insensitive index of
+// movie titles. Titles are folded (NFD, combining marks dropped, lower-cased)
+// and split into words. Each distinct word is posted under its trigrams, so a
+// query word is only compared with the words it shares a trigram with, and
+// each of those once however many titles use it.
+//
+// The index is built from the store on start and kept current by the movie
+// write handlers, so writes made by other processes show up after a restart.
+type movieIndex struct {
+    mu sync.RWMutex
+    movies map[int]indexedMovie
+    // words maps a folded word to the IDs of the movies whose title has it.
+    words map[string]map[int]struct{}
+    // trigrams maps a trigram to the words containing it.
+    trigrams map[string]map[string]struct{}
+    // pending holds the writes made while a rebuild reads the store, to be
+    // replayed onto the rebuilt index. It is nil when no rebuild runs.
+    pending []func()
+    // built is set once a build from the store has been swapped in.
+    built bool
+}
+
+type indexedMovie struct {
+    movie Movie
+    words []string
+}
+
+type indexMatch struct {
+    movie Movie
+    score float64
+}
+
+func newMovieIndex() *movieIndex {
+    return &movieIndex{
+        movies: map[int]indexedMovie{},
+        words: map[string]map[int]struct{}{},
+        trigrams: map[string]map[string]struct{}{},
+    }
+}
+
+// fold normalizes text for matching: "Ação" and "acao" fold alike.
+func fold(text string) string {
+    var b strings.Builder
+    for _, r := range norm.NFD.String(text) {
+        if unicode.Is(unicode.Mn, r) {
+            continue
+        }
+        b.WriteRune(unicode.ToLower(r))
+    }
+    return b.String()
+}
+
+// foldWords folds text and splits it on anything that isn't a letter or digit.
+func foldWords(text string) []string {
+    return strings.FieldsFunc(fold(text), func(r rune) bool {
+        return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+    })
+}
+
+// trigrams returns the trigrams of a word padded with two leading spaces and
+// one trailing space, so prefixes and short words still produce trigrams.
+func trigrams(word string) []string {
+    runes := []rune("  " + word + " ")
+    grams := make([]string, 0, len(runes)-2)
+    for i := 0; i+3 <= len(runes); i++ {
+        grams = append(grams, string(runes[i:i+3]))
+    }
+    return grams
+}
+
+// add indexes m, replacing any earlier version of it.
+func (ix *movieIndex) add(m Movie) {
+    ix.apply(func() { ix.addLocked(m) })
+}
+
+// apply runs write under the lock, and records it when a rebuild is running
+// so swap can apply it again on top of what the rebuild read.
+func (ix *movieIndex) apply(write func()) {
+    ix.mu.Lock()
+    defer ix.mu.Unlock()
+
+    write()
+    if ix.pending != nil {
+        ix.pending = append(ix.pending, write)
+    }
+}
+
+func (ix *movieIndex) addLocked(m Movie) {
+    ix.removeLocked(m.ID)
+
+    entry := indexedMovie{movie: m, words: foldWords(m.Title)}
+    ix.movies[m.ID] = entry
+    for _, word := range entry.words {
+        ids, ok := ix.words[word]
+        if !ok {
+            ids = map[int]struct{}{}
+            ix.words[word] = ids
+            for _, gram := range trigrams(word) {
+                if ix.trigrams[gram] == nil {
+                    ix.trigrams[gram] = map[string]struct{}{}
+                }
+                ix.trigrams[gram][word] = struct{}{}
+            }
+        }
+        ids[m.ID] = struct{}{}
+    }
+}
+
+// update reindexes m if it is already indexed.
+func (ix *movieIndex) update(m Movie) {
+    ix.apply(func() {
+        if _, ok := ix.movies[m.ID]; ok {
+            ix.addLocked(m)
+        }
+    })
+}
+
+// record starts recording writes for the rebuild about to read the store.
+func (ix *movieIndex) record() {
+    ix.mu.Lock()
+    defer ix.mu.Unlock()
+
+    ix.pending = []func(){}
+}
+
+// swap replaces the contents of ix with those of a freshly built index and
+// replays the writes recorded since record, which the rebuild may have read
+// the store too early to see. A nil other just stops recording.
+func (ix *movieIndex) swap(other *movieIndex) {
+    ix.mu.Lock()
+    defer ix.mu.Unlock()
+
+    if other != nil {
+        ix.movies = other.movies
+        ix.words = other.words
+        ix.trigrams = other.trigrams
+        for _, write := range ix.pending {
+            write()
+        }
+        ix.built = true
+    }
+    ix.pending = nil
+}
+
+// loaded reports whether the index has been built from the store.
+func (ix *movieIndex) loaded() bool {
+    ix.mu.RLock()
+    defer ix.mu.RUnlock()
+
+    return ix.built
+}
+
+func (ix *movieIndex) remove(id int) {
+    ix.apply(func() { ix.removeLocked(id) })
+}
+
+func (ix *movieIndex) removeLocked(id int) {
+    entry, ok := ix.movies[id]
+    if !ok {
+        return
+    }
+
+    for _, word := range entry.words {
+        ids := ix.words[word]
+        delete(ids, id)
+        if len(ids) > 0 {
+            continue
+        }
+        delete(ix.words, word)
+        for _, gram := range trigrams(word) {
+            delete(ix.trigrams[gram], word)
+            if len(ix.trigrams[gram]) == 0 {
+                delete(ix.trigrams, gram)
+            }
+        }
+    }
+    delete(ix.movies, id)
+}
+
+// lookup returns up to limit movies whose titles match every word of q,
+// best first.
+func (ix *movieIndex) lookup(q string, limit int) []Movie {
+    words := foldWords(q)
+    if len(words) == 0 {
+        return []Movie{}
+    }
+
+    ix.mu.RLock()
+    defer ix.mu.RUnlock()
+
+    var scores map[int]float64
+    for i, word := range words {
+        // Only the word being typed may be an unfinished prefix.
+        matches := ix.matchWord(word, i == len(words)-1)
+
+        next := map[int]float64{}
+        for id, score := range matches {
+            if i == 0 {
+                next[id] = score
+            } else if total, ok := scores[id]; ok {
+                next[id] = total + score
+            }
+        }
+        scores = next
+    }
+
+    matches := []indexMatch{}
+    for id, score := range scores {
+        matches = append(matches, indexMatch{ix.movies[id].movie, score})
+    }
+    sort.Slice(matches, func(i, j int) bool {
+        if matches[i].score != matches[j].score {
+            return matches[i].score > matches[j].score
+        }
+        return matches[i].movie.ID < matches[j].movie.ID
+    })
+
+    movies := []Movie{}
+    for _, match := range matches {
+        if len(movies) == limit {
+            break
+        }
+        movies = append(movies, match.movie)
+    }
+    return movies
+}
+
+// matchWord scores the indexed words sharing a trigram with q and returns
+// the best score of each movie using one of them. Callers must hold ix.mu.
+func (ix *movieIndex) matchWord(q string, prefix bool) map[int]float64 {
+    candidates := map[string]struct{}{}
+    for _, gram := range trigrams(q) {
+        for word := range ix.trigrams[gram] {
+            candidates[word] = struct{}{}
+        }
+    }
+
+    scores := map[int]float64{}
+    for word := range candidates {
+        score := wordScore(q, word, prefix)
+        if score == 0 {
+            continue
+        }
+        for id := range ix.words[word] {
+            if score > scores[id] {
+                scores[id] = score
+            }
+        }
+    }
+    return scores
+}
+
+// wordScore rates how well query word q matches an indexed word: 1 for an
+// exact match, 0.9 for a prefix of the word being typed, and less for each
+// typo up to maxEdits.
+func wordScore(q, word string, prefix bool) float64 {
+    switch {
+    case word == q:
+        return 1
+    case prefix && strings.HasPrefix(word, q):
+        return 0.9
+    }
+
+    limit := maxEdits(q)
+    if diff := len([]rune(word)) - len([]rune(q)); diff > limit || -diff > limit {
+        return 0
+    }
+    if d := editDistance(q, word); d <= limit {
+        return 0.8 - 0.2*float64(d-1)
+    }
+    return 0
+}
+
+// maxEdits is the number of typos tolerated in a word of q's length.
+func maxEdits(q string) int {
+    switch n := len([]rune(q)); {
+    case n <= 2:
+        return 0
+    case n <= 5:
+        return 1
+    default:
+        return 2
+    }
+}
+
+// editDistance is the optimal string alignment distance between a and b:
+// insertions, deletions, substitutions and adjacent transpositions.
+func editDistance(a, b string) int {
+    x, y := []rune(a), []rune(b)
+    d := make([][]int, len(x)+1)
+    for i := range d {
+        d[i] = make([]int, len(y)+1)
+        d[i][0] = i
+    }
+    for j := range d[0] {
+        d[0][j] = j
+    }
+
+    for i := 1; i <= len(x); i++ {
+        for j := 1; j <= len(y); j++ {
+            cost := 1
+            if x[i-1] == y[j-1] {
+                cost = 0
+            }
+            d[i][j] = minInt(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+            if i > 1 && j > 1 && x[i-1] == y[j-2] && x[i-2] == y[j-1] {
+                d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+            }
+        }
+    }
+
+    return d[len(x)][len(y)]
+}
+
+func minInt(first int, rest ...int) int {
+    for _, n := range rest {
+        if n < first {
+            first = n
+        }
+    }
+    return first
+}
+
+// buildIndex loads every movie from the store into a fresh index. Writes the
+// handlers make to a.index meanwhile are replayed onto it when it is swapped in.
+func (a *App) buildIndex(ctx context.Context) error {
+    a.index.record()
+    index := newMovieIndex()
+    query := MovieQuery{Count: 500, Sort: "id"}
+    for {
+        movies, err := a.Movies.GetMovies(ctx, query)
+        if err != nil {
+            a.index.swap(nil)
+            return err
+        }
+        for _, m := range movies {
+            index.add(m)
+        }
+        if len(movies) < query.Count {
+            break
+        }
+        query.After = movies[len(movies)-1].ID
+    }
+
+    a.index.swap(index)
+    return nil
+}
+
+// Autocomplete answers from this process's in-memory index. It follows the
+// writes this process makes, but movies written through other instances
+// only show up once the index is rebuilt on the next start.
+func (a *App) autocomplete(w http.ResponseWriter, r *http.Request) {
+    count, _ := strconv.Atoi(r.FormValue("count"))
+    if count > 10 || count < 1 {
+        count = 10
+    }
+
+    respondWithJSON(w, http.StatusOK, a.index.lookup(r.FormValue("q"), count))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+    "strings"
+
+    "github.com/mattn/go-sqlite3"
+)
+
+var sqliteDialect = dialect{
+    driver: "sqlite3",
+    migrations: []migration{
+        {
+            version: 1,
+            name: "create_categories_and_movies",
+            up: []string{
+                `CREATE TABLE IF NOT EXISTS categories
+                (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    title VARCHAR(50) NOT NULL
+                )`,
+                `CREATE TABLE IF NOT EXISTS movies
+                (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    title VARCHAR(120) NOT NULL,
+                    cover VARCHAR(255),
+                    category_id INTEGER NOT NULL,
+                    description TEXT,
+                    FOREIGN KEY (category_id) REFERENCES categories(id)
+                )`,
+            },
+            down: []string{
+                "DROP TABLE movies",
+                "DROP TABLE categories",
+            },
+        },
+        {
+            version: 2,
+            name: "add_movies_created_at",
+            // SQLite can't add a column with a non-constant default, so
+            // existing rows are backfilled and inserts set the value.
+            up: []string{
+                "ALTER TABLE movies ADD COLUMN created_at TIMESTAMP",
+                "UPDATE movies SET created_at = CURRENT_TIMESTAMP",
+            },
+            // The bundled SQLite has no DROP COLUMN; rebuild the table.
+            down: []string{
+                `CREATE TABLE movies_without_created_at
+                (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    title VARCHAR(120) NOT NULL,
+                    cover VARCHAR(255),
+                    category_id INTEGER NOT NULL,
+                    description TEXT,
+                    FOREIGN KEY (category_id) REFERENCES categories(id)
+                )`,
+                "INSERT INTO movies_without_created_at SELECT id, title, cover, category_id, description FROM movies",
+                "DROP TABLE movies",
+                "ALTER TABLE movies_without_created_at RENAME TO movies",
+            },
+        },
+        {
+            version: 3,
+            name: "add_movies_fulltext_index",
+            // No full-text index here; SearchMovies falls back to LIKE.
+        },
+        {
+            version: 4,
+            name: "add_version_columns",
+            up: []string{
+                "ALTER TABLE movies ADD COLUMN version INTEGER NOT NULL DEFAULT 1",
+                "ALTER TABLE categories ADD COLUMN version INTEGER NOT NULL DEFAULT 1",
+            },
+            // Rebuild both tables. The new movies table references the new
+            // categories table, and renaming that carries the reference over.
+            down: []string{
+                `CREATE TABLE categories_without_version
+                (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    title VARCHAR(50) NOT NULL
+                )`,
+                "INSERT INTO categories_without_version SELECT id, title FROM categories",
+                `CREATE TABLE movies_without_version
+                (
+                    id INTEGER PRIMARY KEY AUTOINCREMENT,
+                    title VARCHAR(120) NOT NULL,
+                    cover VARCHAR(255),
+                    category_id INTEGER NOT NULL,
+                    description TEXT,
+                    created_at TIMESTAMP,
+                    FOREIGN KEY (category_id) REFERENCES categories_without_version(id)
+                )`,
+                "INSERT INTO movies_without_version SELECT id, title, cover, category_id, description, created_at FROM movies",
+                "DROP TABLE movies",
+                "DROP TABLE categories",
+                "ALTER TABLE categories_without_version RENAME TO categories",
+                "ALTER TABLE movies_without_version RENAME TO movies",
+            },
+        },
+    },
+    foreignKeyViolation: sqliteForeignKeyViolation,
+    undefinedTable: sqliteUndefinedTable,
+    truncate: []string{
+        "DELETE FROM movies",
+        "DELETE FROM categories",
+        "DELETE FROM sqlite_sequence WHERE name IN ('movies', 'categories')",
+    },
+}
+
+// sqliteForeignKeyViolation matches SQLITE_CONSTRAINT_FOREIGNKEY.
+func sqliteForeignKeyViolation(err error) bool {
+    e, ok := err.(sqlite3.Error)
+    return ok && e.ExtendedCode == sqlite3.ErrConstraintForeignKey
+}
+
+// sqliteUndefinedTable matches "no such table", which SQLite reports as a
+// plain SQLITE_ERROR.
+func sqliteUndefinedTable(err error) bool {
+    e, ok := err.(sqlite3.Error)
+    return ok && e.Code == sqlite3.ErrError && strings.HasPrefix(e.Error(), "no such table")
+}
+
+// sqliteDSN turns sqlite://path/to/movies.db (or a file: DSN) into a
+// go-sqlite3 DSN with foreign keys enforced on every connection.
+func sqliteDSN(connectionString string) string {
+    dsn := connectionString
+    if strings.HasPrefix(dsn, "sqlite://") {
+        dsn = "file:" + strings.TrimPrefix(dsn, "sqlite://")
+    }
+
+    separator := "?"
+    if strings.Contains(dsn, "?") {
+        separator = "&"
+    }
+
+    return dsn + separator + "_foreign_keys=1&_busy_timeout=5000"
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+// dialect holds the statements that differ between SQL backends.
+type dialect struct {
+    driver string
+    migrations []migration
+    // returningID reads generated keys with INSERT ... RETURNING id instead of
+    // sql.Result.LastInsertId.
+    returningID bool
+    // numberedPlaceholders rewrites ? placeholders to $1, $2, ...
+    numberedPlaceholders bool
+    // fullText searches with MATCH ... AGAINST over the movies_fulltext index.
+    fullText bool
+    // foreignKeyViolation recognizes the driver's foreign key errors.
+    foreignKeyViolation func(error) bool
+    // undefinedTable recognizes the driver's error for a missing table.
+    undefinedTable func(error) bool
+    // migrationLock takes a session-level advisory lock and returns 1 once
+    // it is held; migrationUnlock releases it. SQLite needs neither, since
+    // its writers already take turns on the database file.
+    migrationLock string
+    migrationUnlock string
+    truncate []string
+}
+
+// sqlStore implements MovieStore and CategoryStore on top of database/sql.
+// Every query goes through a cached prepared statement, so user input never
+// ends up in the SQL text.
+type sqlStore struct {
+    db *sql.DB
+    dialect dialect
+
+    mu sync.RWMutex
+    statements map[string]*sql.Stmt
+}
+
+func newSQLStore(db *sql.DB, d dialect) *sqlStore {
+    return &sqlStore{db: db, dialect: d, statements: map[string]*sql.Stmt{}}
+}
+
+// dialectFor picks the dialect for a DATABASE_URL and returns the DSN its
+// driver expects. Anything that isn't recognised is handed to MySQL as is.
+func dialectFor(connectionString string) (dialect, string, error) {
+    switch {
+    case strings.HasPrefix(connectionString, "postgres://"), strings.HasPrefix(connectionString, "postgresql://"):
+        return postgresDialect, connectionString, nil
+    case strings.HasPrefix(connectionString, "sqlite://"), strings.HasPrefix(connectionString, "file:"):
+        return sqliteDialect, sqliteDSN(connectionString), nil
+    case strings.HasPrefix(connectionString, "mysql://"):
+        dsn, err := mysqlDSN(connectionString)
+        return mysqlDialect, dsn, err
+    default:
+        return mysqlDialect, connectionString, nil
+    }
+}
+
+// rebind converts a query written with ? placeholders to the dialect's
+// placeholder syntax.
+func (s *sqlStore) rebind(query string) string {
+    if !s.dialect.numberedPlaceholders {
+        return query
+    }
+
+    var b strings.Builder
+    n := 0
+    for _, r := range query {
+        if r == '?' {
+            n++
+            b.WriteString("$" + strconv.Itoa(n))
+            continue
+        }
+        b.WriteRune(r)
+    }
+
+    return b.String()
+}
+
+// prepare returns the cached prepared statement for query, preparing it on
+// first use. The round trip to the server happens outside the lock, so a
+// slow prepare doesn't hold up every other query; when two callers race,
+// the first statement stored wins and the other is closed.
+func (s *sqlStore) prepare(ctx context.Context, query string) (*sql.Stmt, error) {
+    s.mu.RLock()
+    stmt, ok := s.statements[query]
+    s.mu.RUnlock()
+    if ok {
+        return stmt, nil
+    }
+
+    stmt, err := s.db.PrepareContext(ctx, s.rebind(query))
+    if err != nil {
+        return nil, err
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if cached, ok := s.statements[query]; ok {
+        stmt.Close()
+        return cached, nil
+    }
+    s.statements[query] = stmt
+
+    return stmt, nil
+}
+
+// exec runs a statement addressed at one row and returns missing when it
+// touched none.
+func (s *sqlStore) exec(ctx context.Context, missing error, query string, args ...interface{}) error {
+    stmt, err := s.prepare(ctx, query)
+    if err != nil {
+        return err
+    }
+
+    result, err := stmt.ExecContext(ctx, args...)
+    if err != nil {
+        return err
+    }
+
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if affected == 0 {
+        return missing
+    }
+
+    return nil
+}
+
+// foreignKey replaces a foreign key violation with the domain error the
+// caller gives it, and passes any other error through.
+func (s *sqlStore) foreignKey(err error, violation error) error {
+    if err != nil && s.dialect.foreignKeyViolation(err) {
+        return violation
+    }
+    return err
+}
+
+// insert runs an INSERT statement and stores the generated primary key in id.
+func (s *sqlStore) insert(ctx context.Context, query string, id *int, args ...interface{}) error {
+    if s.dialect.returningID {
+        stmt, err := s.prepare(ctx, query + " RETURNING id")
+        if err != nil {
+            return err
+        }
+        return stmt.QueryRowContext(ctx, args...).Scan(id)
+    }
+
+    stmt, err := s.prepare(ctx, query)
+    if err != nil {
+        return err
+    }
+
+    // The key comes back with the INSERT's own result, so it always belongs
+    // to the connection that ran the statement.
+    result, err := stmt.ExecContext(ctx, args...)
+    if err != nil {
+        return err
+    }
+
+    lastInsertID, err := result.LastInsertId()
+    if err != nil {
+        return err
+    }
+    *id = int(lastInsertID)
+
+    return nil
+}
+
+// update runs UPDATE table SET assignments on row id and bumps its version.
+// A non-zero *version must still be the stored one, or nothing is written
+// and errVersionConflict is returned. *version ends up as the version this
+// write produced, read in the same statement or transaction as the write so
+// a concurrent writer's version can't be returned instead. missing is
+// returned when the row does not exist.
+func (s *sqlStore) update(ctx context.Context, table, assignments string, id int, version *int, missing error, args ...interface{}) error {
+    statement := "UPDATE " + table + " SET " + assignments + ", version=version+1 WHERE id=?"
+    args = append(args, id)
+    if *version != 0 {
+        statement += " AND version=?"
+        args = append(args, *version)
+    }
+
+    if s.dialect.returningID {
+        stmt, err := s.prepare(ctx, statement + " RETURNING version")
+        if err != nil {
+            return err
+        }
+        err = stmt.QueryRowContext(ctx, args...).Scan(version)
+        if err != sql.ErrNoRows {
+            return err
+        }
+        // Nothing was written; the stored version tells why.
+        return s.updateMissed(ctx, table, id, missing)
+    }
+
+    // Prepare both statements before the transaction takes a connection, so
+    // a pool of one can't deadlock.
+    stmt, err := s.prepare(ctx, statement)
+    if err != nil {
+        return err
+    }
+    read, err := s.prepare(ctx, "SELECT version FROM " + table + " WHERE id=?")
+    if err != nil {
+        return err
+    }
+
+    tx, err := s.db.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    result, err := tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+    if err != nil {
+        return err
+    }
+    affected, err := result.RowsAffected()
+    if err != nil {
+        return err
+    }
+    if affected == 0 {
+        tx.Rollback()
+        return s.updateMissed(ctx, table, id, missing)
+    }
+
+    // The UPDATE holds the row until commit, so this reads its own version.
+    if err := tx.StmtContext(ctx, read).QueryRowContext(ctx, id).Scan(version); err != nil {
+        return err
+    }
+    return tx.Commit()
+}
+
+// updateMissed explains an UPDATE that matched no row: missing when the row
+// is gone, errVersionConflict when its version moved on.
+func (s *sqlStore) updateMissed(ctx context.Context, table string, id int, missing error) error {
+    stmt, err := s.prepare(ctx, "SELECT version FROM " + table + " WHERE id=?")
+    if err != nil {
+        return err
+    }
+
+    var current int
+    switch err := stmt.QueryRowContext(ctx, id).Scan(&current); {
+    case err == sql.ErrNoRows:
+        return missing
+    case err != nil:
+        return err
+    }
+    return errVersionConflict
+}
+
+// truncate empties both tables and resets their auto-increment counters.
+func (s *sqlStore) truncate() error {
+    for _, statement := range s.dialect.truncate {
+        if _, err := s.db.Exec(statement); err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Close releases every cached prepared statement.
+func (s *sqlStore) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    for query, stmt := range s.statements {
+        stmt.Close()
+        delete(s.statements, query)
+    }
+
+    return nil
+}
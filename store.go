@@ -0,0 +1,28 @@
+package main
+
+import (
+    "context"
+)
+
+// MovieStore is the persistence contract the movie handlers depend on.
+type MovieStore interface {
+    GetMovie(ctx context.Context, m *Movie) error
+    GetMovies(ctx context.Context, query MovieQuery) ([]Movie, error)
+    CountMovies(ctx context.Context, query MovieQuery) (int, error)
+    SearchMovies(ctx context.Context, q string, limit int) ([]SearchResult, error)
+    CreateMovie(ctx context.Context, m *Movie) error
+    // UpdateMovie returns errVersionConflict when m.Version is set and stale.
+    UpdateMovie(ctx context.Context, m *Movie) error
+    DeleteMovie(ctx context.Context, m *Movie) error
+}
+
+// CategoryStore is the persistence contract the category handlers depend on.
+type CategoryStore interface {
+    GetCategory(ctx context.Context, c *Category) error
+    GetCategories(ctx context.Context) ([]Category, error)
+    CreateCategory(ctx context.Context, c *Category) error
+    // UpdateCategory returns errVersionConflict when c.Version is set and stale.
+    UpdateCategory(ctx context.Context, c *Category) error
+    DeleteCategory(ctx context.Context, c *Category) error
+    GetCatalog(ctx context.Context, query CatalogQuery) ([]Catalog, error)
+}
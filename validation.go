@@ -0,0 +1,113 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/url"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// rule checks one field value and returns the violation's code and message,
+// or an empty code when the value passes.
+type rule func(value string) (code, message string)
+
+// fieldRules binds a JSON field name and value to the rules it must pass.
+type fieldRules struct {
+    field string
+    value string
+    rules []rule
+}
+
+func field(name, value string, rules ...rule) fieldRules {
+    return fieldRules{field: name, value: value, rules: rules}
+}
+
+// validateFields runs every rule and collects all violations. After a
+// field's first violation its remaining rules are skipped.
+func validateFields(fields ...fieldRules) []fieldError {
+    violations := []fieldError{}
+    for _, f := range fields {
+        for _, check := range f.rules {
+            if code, message := check(f.value); code != "" {
+                violations = append(violations, fieldError{Field: f.field, Code: code, Message: message})
+                break
+            }
+        }
+    }
+    return violations
+}
+
+func required(value string) (string, string) {
+    if strings.TrimSpace(value) == "" {
+        return "required", "Must not be empty"
+    }
+    return "", ""
+}
+
+// maxLength limits a value to n characters, as VARCHAR(n) does.
+func maxLength(n int) rule {
+    return func(value string) (string, string) {
+        if utf8.RuneCountInString(value) > n {
+            return "too_long", fmt.Sprintf("Must be at most %d characters", n)
+        }
+        return "", ""
+    }
+}
+
+// maxBytes limits a value to n bytes, as TEXT columns do.
+func maxBytes(n int) rule {
+    return func(value string) (string, string) {
+        if len(value) > n {
+            return "too_long", fmt.Sprintf("Must be at most %d bytes", n)
+        }
+        return "", ""
+    }
+}
+
+// urlReference accepts an absolute http(s) URL or a relative reference such
+// as "covers/matrix.jpg". Empty values pass; pair it with required if needed.
+func urlReference(value string) (string, string) {
+    if value == "" {
+        return "", ""
+    }
+    invalid := strings.IndexFunc(value, func(r rune) bool {
+        return unicode.IsSpace(r) || unicode.IsControl(r)
+    }) >= 0
+
+    u, err := url.Parse(value)
+    if invalid || err != nil {
+        return "invalid_url", "Must be a URL"
+    }
+    if u.Scheme != "" && ((u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+        return "invalid_url", "Must be an http or https URL"
+    }
+    return "", ""
+}
+
+// validateMovie checks m against the movies table: the column lengths, the
+// cover's URL format and that its category exists.
+func (a *App) validateMovie(ctx context.Context, m Movie) ([]fieldError, error) {
+    violations := validateFields(
+        field("titulo", m.Title, required, maxLength(120)),
+        field("imagem", m.Cover, maxLength(255), urlReference),
+        field("descricao", m.Description, maxBytes(65535)),
+    )
+
+    if m.Category == 0 {
+        return append(violations, fieldError{Field: "id_categoria", Code: "required", Message: "Must not be empty"}), nil
+    }
+    err := a.Categories.GetCategory(ctx, &Category{ID: m.Category})
+    if _, ok := err.(*NotFoundError); ok {
+        return append(violations, fieldError{Field: errUnknownCategory.Field, Code: errUnknownCategory.Code(), Message: errUnknownCategory.Message}), nil
+    }
+    return violations, err
+}
+
+// validateCategory checks c against the categories table.
+func validateCategory(c Category) []fieldError {
+    return validateFields(
+        field("titulo", c.Title, required, maxLength(50)),
+    )
+}